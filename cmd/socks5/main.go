@@ -23,6 +23,8 @@ type Conf struct {
 	Count    int    `yaml:"count"`
 	Batch    int    `yaml:"batch"`
 	Debug    bool   `yaml:"debug"`
+	Pipeline bool   `yaml:"pipeline"`
+	Pool     int    `yaml:"pool"`
 }
 
 var flagConfig string
@@ -49,13 +51,22 @@ func main() {
 	} else {
 		l = logger.NewNopLogLogger()
 	}
-	//sc := socks5.NewClient(c.Addr, l)
+	// Client可以并发共享
+	opts := []socks5.ClientOption{socks5.WithCredentials(c.User, c.Password)}
+	if c.Pipeline {
+		opts = append(opts, socks5.WithPipeline())
+	}
+	if c.Pool > 0 {
+		opts = append(opts, socks5.WithPool(socks5.PoolConfig{MaxIdle: c.Pool}))
+	}
+	sc := socks5.NewClient(c.Addr, l, opts...)
+	defer sc.Close()
 	csvHead()
 	jobCount := c.Count
 	jobBatch := c.Batch
 	csvCount(jobBatch * jobCount)
 	for i := 0; i < jobCount; i++ {
-		job(l, c, jobBatch)
+		job(sc, jobBatch)
 	}
 	//"=SUBTOTAL(1,A1:A100)","=SUBTOTAL(1,B1:B100)/1000",,
 
@@ -75,24 +86,45 @@ func csvHead() {
 	bl.Append(`curl time s`)
 	bl.Append("url")
 	bl.Append("body len")
+	bl.Append("tcp ms")
+	bl.Append("auth ms")
+	bl.Append("connect ms")
 	fmt.Println(bl.String())
 }
-func job(l logger.Logger, c Conf, total int) {
+func job(sc *socks5.Client, total int) {
 	wg := sync.WaitGroup{}
 	for i := 0; i < total; i++ {
-		sc := socks5.NewClient(c.Addr, l)
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			curl("https://www.example.com", sc, c.User, c.Password)
+			curl("https://www.example.com", sc)
 		}()
 	}
 	wg.Wait()
 }
-func curl(url1 string, sc *socks5.Client, user, password string) {
+func curl(url1 string, sc *socks5.Client) {
 	// 用网络连接创建Transport
 	bl := logger.NewBufferLogger()
+	// 分阶段耗时,区分慢在TCP、认证还是代理的上游连接
+	// 多级代理时trace只描述最后一跳,tcp包含经由前面各跳的握手
+	var dialStart, authStart, connectStart time.Time
+	var tcpTime, authTime, connectTime time.Duration
+	trace := &socks5.ClientTrace{
+		ProxyDialStart: func(string) { dialStart = time.Now() },
+		ProxyDialDone:  func(string, error) { tcpTime = time.Since(dialStart) },
+		AuthStart:      func(byte) { authStart = time.Now() },
+		AuthDone:       func(byte, error) { authTime = time.Since(authStart) },
+		ConnectRequestSent: func(string) {
+			connectStart = time.Now()
+		},
+		ConnectReplyReceived: func(string, error) {
+			connectTime = time.Since(connectStart)
+		},
+	}
 	defer func() {
+		bl.Append(fmt.Sprintf("%d", tcpTime.Milliseconds()))
+		bl.Append(fmt.Sprintf("%d", authTime.Milliseconds()))
+		bl.Append(fmt.Sprintf("%d", connectTime.Milliseconds()))
 		fmt.Println(bl.String())
 	}()
 	transport := &http.Transport{
@@ -100,7 +132,7 @@ func curl(url1 string, sc *socks5.Client, user, password string) {
 			//fmt.Println("DialContext", network, addr)
 			if network == "tcp" {
 				t1 := time.Now()
-				conn, err := sc.DialWithUsernamePassword(context.Background(), addr, user, password)
+				conn, err := sc.DialContext(socks5.WithClientTrace(context.Background(), trace), network, addr)
 				bl.Append(fmt.Sprintf("%d", time.Since(t1).Milliseconds()))
 				if err != nil {
 					fmt.Println("DialContext.err", addr, err)
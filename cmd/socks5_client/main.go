@@ -41,7 +41,7 @@ func main() {
 	log.Printf("c %#v", c)
 	l := logger.NewDefaultLogger()
 	sc := socks5.NewClient(c.Addr, l)
-	// cc, err := sc.Dial(context.Background(), c.TargetAddr)
+	// cc, err := sc.DialContext(context.Background(), "tcp", c.TargetAddr)
 	cc, err := sc.DialWithUsernamePassword(context.Background(), c.TargetAddr, c.User, c.Password)
 	if err != nil {
 		log.Println("err", err)
@@ -4,12 +4,18 @@ import (
 	"context"
 	"flag"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/matteo-gz/tyflo/pkg/config"
 	"github.com/matteo-gz/tyflo/pkg/logger"
 	"github.com/matteo-gz/tyflo/pkg/protocol/socks5"
 )
 
+const shutdownTimeout = 10 * time.Second
+
 type UserAuth struct {
 	Username string `yaml:"username"`
 	Password string `yaml:"password"`
@@ -68,7 +74,13 @@ func main() {
 		return
 	}
 	log.Println("ok")
-	// 等待退出
-	ch := make(chan struct{})
+	// 等待退出信号,给进行中的会话留出结束时间
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
 	<-ch
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err = ss.Shutdown(ctx); err != nil {
+		log.Println("shutdown", err)
+	}
 }
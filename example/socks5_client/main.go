@@ -2,11 +2,9 @@ package main
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"io"
 	"log"
-	"net"
 	"net/http"
 
 	io2 "github.com/matteo-gz/tyflo/pkg/io"
@@ -22,23 +20,9 @@ func main() {
 }
 
 func curl(url1 string) {
-	// 用网络连接创建Transport
-	transport := &http.Transport{
-		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			fmt.Println("DialContext", network, addr)
-			if network == "tcp" {
-				l := logger.NewDefaultLogger()
-				c := socks5.NewClient(":1079", l)
-				conn, err := c.Dial(ctx, addr)
-				if err != nil {
-					return nil, err
-				}
-				return conn, nil
-			}
-			// return conn,nil
-			return nil, errors.New("not tcp")
-		},
-	}
+	// 用代理客户端创建Transport
+	l := logger.NewDefaultLogger()
+	transport := socks5.NewClient(":1079", l).Transport()
 
 	// 用Transport创建Client
 	client := &http.Client{Transport: transport}
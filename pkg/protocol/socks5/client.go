@@ -5,139 +5,270 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"time"
 
 	"github.com/matteo-gz/tyflo/pkg/logger"
+	"golang.org/x/net/proxy"
 )
 
-// ErrReplyFail 回复失败错误
+// ErrReplyFail 回复失败错误,只用于REP失败,用户名密码被拒绝时为ErrAuthFailed
 var ErrReplyFail = errors.New("reply fail")
 
+// ErrNetworkNotSupport 只支持tcp
+var ErrNetworkNotSupport = errors.New("network not support")
+
+var (
+	_ proxy.Dialer        = (*Client)(nil)
+	_ proxy.ContextDialer = (*Client)(nil)
+)
+
 // NewClient 创建新的SOCKS5客户端
-func NewClient(serverAddress string, l logger.Logger) *Client {
-	return &Client{serverAddress: serverAddress, log: l}
+func NewClient(serverAddress string, l logger.Logger, opts ...ClientOption) *Client {
+	c := &Client{
+		serverAddress: serverAddress,
+		log:           l,
+		dialTimeout:   dialTimeout,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.poolConfig != nil && c.poolConfig.MaxIdle > 0 {
+		c.pool = newConnPool(c, *c.poolConfig)
+	}
+	return c
 }
 
 // Client SOCKS5客户端结构体
+// 创建后配置不再改变,可以被多个goroutine共享,每次Dial返回独立的连接
 type Client struct {
-	c             net.Conn
 	serverAddress string
 	log           logger.Logger
+	auths         []ClientAuthenticator
+	dialTimeout   time.Duration
+	forward       proxy.ContextDialer
+	phaseTimeout  time.Duration
+	pipeline      bool
+	resolveMode   ResolveMode
+	resolver      *net.Resolver
+	poolConfig    *PoolConfig
+	pool          *connPool
 }
 
-// Dial 建立无认证的SOCKS5连接
-func (c *Client) Dial(ctx context.Context, address string) (conn net.Conn, err error) {
-	if c.c, err = dial(ctx, c.serverAddress); err != nil {
-		return
-	}
-	if err = c.negotiate(); err != nil {
-		return
+type ClientOption func(*Client)
+
+// WithCredentials 使用用户名密码认证,Dial/DialContext及Transport都会带上
+func WithCredentials(user, password string) ClientOption {
+	return func(c *Client) {
+		c.auths = userPassAuths(user, password)
 	}
-	if err = c.authenticate(ctx); err != nil {
-		return
+}
+
+// WithDialTimeout 连接代理服务器的超时时间
+func WithDialTimeout(d time.Duration) ClientOption {
+	return func(c *Client) {
+		c.dialTimeout = d
 	}
-	if err = c.handleRequest(ctx, address); err != nil {
-		return
+}
+
+// Dial 实现proxy.Dialer
+func (c *Client) Dial(network, address string) (net.Conn, error) {
+	return c.DialContext(context.Background(), network, address)
+}
+
+// DialContext 实现proxy.ContextDialer,配置了用户名密码时进行认证
+func (c *Client) DialContext(ctx context.Context, network, address string) (conn net.Conn, err error) {
+	switch network {
+	case tcp, "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrNetworkNotSupport, network)
 	}
-	return c.c, nil
+	return c.connect(ctx, address, nil)
 }
 
 // DialWithUsernamePassword 使用用户名密码建立SOCKS5连接
 func (c *Client) DialWithUsernamePassword(ctx context.Context, address, user, password string) (conn net.Conn, err error) {
-	if c.c, err = dial(ctx, c.serverAddress); err != nil {
-		c.log.DebugF(ctx, "dial")
+	return c.connect(ctx, address, userPassAuths(user, password))
+}
+
+// connect 完成握手并发送CONNECT请求,auths为nil时使用Client配置的认证方法
+func (c *Client) connect(ctx context.Context, address string, auths []ClientAuthenticator) (conn net.Conn, err error) {
+	defer func() {
+		ContextClientTrace(ctx).handshakeDone(err)
+	}()
+	if address, err = c.resolveAddress(ctx, address); err != nil {
 		return
 	}
-	if err = c.negotiateWithUserPassword(); err != nil {
-		c.log.DebugF(ctx, "negotiateWithUserPassword")
-		return
+	pooled := auths == nil
+	if pooled {
+		auths = c.authenticators()
 	}
-	if err = c.authenticateWithUserPassword(ctx, user, password); err != nil {
-		c.log.DebugF(ctx, "authenticateWithUserPassword")
-		return
+	if pooled && c.pool != nil {
+		if conn = c.pool.get(); conn != nil {
+			if err = c.connectPooled(ctx, conn, address); err == nil {
+				return conn, nil
+			}
+			_ = conn.Close()
+			if errors.Is(err, ErrReplyFail) || ctx.Err() != nil {
+				// 代理明确拒绝或ctx已结束,不再重试
+				return nil, err
+			}
+			// 连接已失效,重新握手
+			c.pool.markStale()
+			c.log.DebugF(ctx, "pooled conn", err)
+		}
 	}
-	c.log.DebugF(ctx, "handleRequest.before", address)
-	if err = c.handleRequest(ctx, address); err != nil {
-		c.log.DebugF(ctx, "handleRequest")
-		return
+	if c.pipeline {
+		conn, err = c.connectPipelined(ctx, address, auths)
+		if !errors.Is(err, errPipelineFallback) {
+			return
+		}
 	}
-	return c.c, nil
-}
-
-// negotiate 进行无认证协商
-func (c *Client) negotiate() error {
-	req := NewClientNegotiateReq()
-	req.SetNoAuthenticationRequired()
-	_, err := c.c.Write(req.Bytes())
-	return err
+	return c.session(ctx, func(conn net.Conn) error {
+		if err := c.handshake(ctx, conn, auths); err != nil {
+			return err
+		}
+		c.log.DebugF(ctx, "handleRequest.before", address)
+		return c.handleRequest(ctx, conn, address)
+	})
 }
 
-// negotiateWithUserPassword 进行用户名密码认证协商
-func (c *Client) negotiateWithUserPassword() error {
-	req := NewClientNegotiateReq()
-	req.SetUsernamePassword()
-	_, err := c.c.Write(req.Bytes())
-	return err
+// connectPooled 在已认证的连接上发送CONNECT请求
+func (c *Client) connectPooled(ctx context.Context, conn net.Conn, address string) (err error) {
+	stop := guard(ctx, conn)
+	err = c.handleRequest(ctx, conn, address)
+	if !stop() && err == nil {
+		err = &HandshakeError{Phase: PhaseRequest, Err: ctx.Err()}
+	}
+	return c.proxyError(err)
 }
 
-// authenticate 进行无认证验证
-func (c *Client) authenticate(ctx context.Context) error {
-	r := NewServerNegotiateReply()
-	if err := r.Decode(c.c); err != nil {
-		return err
+// dialServer 连接代理服务器,配置了forward时经由forward连接
+func (c *Client) dialServer(ctx context.Context) (conn net.Conn, err error) {
+	trace := ContextClientTrace(ctx)
+	trace.proxyDialStart(c.serverAddress)
+	defer func() {
+		trace.proxyDialDone(c.serverAddress, err)
+	}()
+	if c.forward != nil {
+		// 前面的跳不触发trace,经由它们连上本代理的耗时都计入ProxyDialDone
+		return c.forward.DialContext(WithClientTrace(ctx, nil), tcp, c.serverAddress)
 	}
-	if r.Method == MethodNoAuthenticationRequired {
-		return nil
+	d := &net.Dialer{
+		Timeout:   c.dialTimeout,
+		KeepAlive: keepAlive,
 	}
-	return ErrMethodNotSupport
+	return d.DialContext(ctx, tcp, c.serverAddress)
 }
 
-// authenticateWithUserPassword 进行用户名密码认证
-func (c *Client) authenticateWithUserPassword(ctx context.Context, user, password string) error {
-	r := NewServerNegotiateReply()
-	if err := r.Decode(c.c); err != nil {
-		c.log.DebugF(ctx, "decode")
+// handshake 完成协商和认证
+func (c *Client) handshake(ctx context.Context, conn net.Conn, auths []ClientAuthenticator) error {
+	var a ClientAuthenticator
+	if err := c.phase(ctx, conn, PhaseNegotiate, func() (err error) {
+		a, err = c.negotiate(conn, auths)
+		return
+	}); err != nil {
 		return err
 	}
-	switch r.Method {
-	case MethodNoAuthenticationRequired:
-		c.log.DebugF(ctx, "no authentication required")
-		return nil
-	case MethodUsernamePassword:
-		req := NewUsernamePasswordReq()
-		err := req.SetUsernamePassword(user, password)
-		if err != nil {
-			c.log.DebugF(ctx, "SetUsernamePassword")
-			return err
-		}
-		c.log.DebugF(ctx, "NewUsernamePasswordReq")
-		_, err = c.c.Write(req.Bytes())
-		if err != nil {
-			c.log.DebugF(ctx, "Write")
-			return err
-		}
-		err = NewUsernamePasswordReply().Decode(c.c)
-		c.log.DebugF(ctx, "NewUsernamePasswordReply.Decode", err)
-		return err
-	default:
-		return fmt.Errorf("method%v %w", r.Method, ErrMethodNotSupport)
+	c.log.DebugF(ctx, "authenticate", a.Method())
+	trace := ContextClientTrace(ctx)
+	trace.methodSelected(a.Method())
+	trace.authStart(a.Method())
+	err := c.phase(ctx, conn, PhaseAuth, func() error {
+		return a.Authenticate(ctx, conn)
+	})
+	trace.authDone(a.Method(), err)
+	return err
+}
+
+// userPassAuths 同时提供无认证和用户名密码认证,由服务端选择
+func userPassAuths(user, password string) []ClientAuthenticator {
+	return []ClientAuthenticator{NoAuth{}, NewUserPassAuth(user, password)}
+}
+
+// authenticators 没有配置认证方法时只提供无认证
+func (c *Client) authenticators() []ClientAuthenticator {
+	if len(c.auths) == 0 {
+		return []ClientAuthenticator{NoAuth{}}
 	}
+	return c.auths
 }
 
 // handleRequest 处理SOCKS5请求
-func (c *Client) handleRequest(ctx context.Context, address string) (err error) {
+func (c *Client) handleRequest(ctx context.Context, conn net.Conn, address string) (err error) {
+	_, err = c.request(ctx, conn, CmdCONNECT, address)
+	return
+}
+
+// request 发送cmd请求并读取回复
+func (c *Client) request(ctx context.Context, conn net.Conn, cmd byte, address string) (re *ServerReply, err error) {
 	r := NewClientRequest()
-	if err = r.SetCmdConnect(address); err != nil {
-		return err
+	if err = r.SetCmd(cmd, address); err != nil {
+		return
 	}
-	if _, err = c.c.Write(r.Bytes()); err != nil {
-		return err
+	// 只跟踪CONNECT
+	var trace *ClientTrace
+	if cmd == CmdCONNECT {
+		trace = ContextClientTrace(ctx)
 	}
+	err = c.phase(ctx, conn, PhaseRequest, func() (err error) {
+		if _, err = conn.Write(r.Bytes()); err != nil {
+			return
+		}
+		trace.connectRequestSent(address)
+		re, err = c.readReply(conn)
+		trace.connectReplyReceived(re, err)
+		return
+	})
+	return
+}
+
+// readReply 读取回复,REP不为成功时返回ReplyError
+func (c *Client) readReply(conn net.Conn) (*ServerReply, error) {
 	re := NewServerReply()
-	if err = re.Decode(c.c); err != nil {
-		return err
+	if err := re.Decode(conn); err != nil {
+		return nil, err
 	}
 	if re.REP != RepSucceeded {
-		return fmt.Errorf("%w %v", ErrReplyFail, re.REP)
+		return re, c.replyError(re.REP)
+	}
+	return re, nil
+}
+
+// Resolve 通过代理解析域名(tor RESOLVE扩展)
+func (c *Client) Resolve(ctx context.Context, host string) (ip net.IP, err error) {
+	re, err := c.resolve(ctx, CmdResolve, net.JoinHostPort(host, "0"))
+	if err != nil {
+		return
+	}
+	if re.ATYP == ATYPDomainName {
+		return nil, ErrATYPInvalid
+	}
+	return net.IP(re.BNDAddr), nil
+}
+
+// ResolvePTR 通过代理反向解析IP(tor RESOLVE_PTR扩展)
+func (c *Client) ResolvePTR(ctx context.Context, ip net.IP) (host string, err error) {
+	re, err := c.resolve(ctx, CmdResolvePTR, net.JoinHostPort(ip.String(), "0"))
+	if err != nil {
+		return
+	}
+	if re.ATYP != ATYPDomainName {
+		return "", ErrATYPInvalid
+	}
+	return re.host, nil
+}
+
+func (c *Client) resolve(ctx context.Context, cmd byte, address string) (re *ServerReply, err error) {
+	conn, err := c.session(ctx, func(conn net.Conn) (err error) {
+		if err = c.handshake(ctx, conn, c.authenticators()); err != nil {
+			return
+		}
+		re, err = c.request(ctx, conn, cmd, address)
+		return
+	})
+	if err != nil {
+		return
 	}
-	return nil
+	_ = conn.Close()
+	return re, nil
 }
@@ -0,0 +1,102 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// ClientAuthenticator 客户端认证方法,与服务端的Authenticator对应
+type ClientAuthenticator interface {
+	// Method 协商时提供的方法,私有方法使用0x80-0xFE
+	Method() byte
+	// Authenticate 服务端选择该方法后在conn上完成子协商
+	Authenticate(ctx context.Context, conn net.Conn) error
+}
+
+var (
+	_ ClientAuthenticator = NoAuth{}
+	_ ClientAuthenticator = (*UserPassAuth)(nil)
+)
+
+// NoAuth 无需认证
+type NoAuth struct{}
+
+func (NoAuth) Method() byte {
+	return MethodNoAuthenticationRequired
+}
+
+func (NoAuth) Authenticate(ctx context.Context, conn net.Conn) error {
+	return nil
+}
+
+// UserPassAuth RFC1929用户名密码认证
+type UserPassAuth struct {
+	user     string
+	password string
+}
+
+// NewUserPassAuth 创建用户名密码认证方法
+func NewUserPassAuth(user, password string) *UserPassAuth {
+	return &UserPassAuth{user: user, password: password}
+}
+
+func (a *UserPassAuth) Method() byte {
+	return MethodUsernamePassword
+}
+
+func (a *UserPassAuth) Authenticate(ctx context.Context, conn net.Conn) error {
+	req, err := a.request()
+	if err != nil {
+		return err
+	}
+	if _, err = conn.Write(req); err != nil {
+		return err
+	}
+	return NewUsernamePasswordReply().Decode(conn)
+}
+
+func (a *UserPassAuth) request() ([]byte, error) {
+	req := NewUsernamePasswordReq()
+	if err := req.SetUsernamePassword(a.user, a.password); err != nil {
+		return nil, err
+	}
+	return req.Bytes(), nil
+}
+
+// WithClientAuthenticator 按顺序提供的认证方法,替换WithCredentials的设置
+func WithClientAuthenticator(a ...ClientAuthenticator) ClientOption {
+	return func(c *Client) {
+		c.auths = a
+	}
+}
+
+// negotiate 提供auths中的方法,返回服务端选择的方法
+func (c *Client) negotiate(conn net.Conn, auths []ClientAuthenticator) (ClientAuthenticator, error) {
+	methods := make([]byte, len(auths))
+	for i, a := range auths {
+		methods[i] = a.Method()
+	}
+	req := NewClientNegotiateReq()
+	req.SetMethods(methods...)
+	if _, err := conn.Write(req.Bytes()); err != nil {
+		return nil, err
+	}
+	r := NewServerNegotiateReply()
+	if err := r.Decode(conn); err != nil {
+		return nil, err
+	}
+	for _, a := range auths {
+		if a.Method() == r.Method {
+			return a, nil
+		}
+	}
+	switch r.Method {
+	case MethodNoAuthenticationRequired:
+		// 服务端不要求认证时直接使用
+		return NoAuth{}, nil
+	case MethodNoAcceptable:
+		return nil, ErrNoAcceptableMethods
+	}
+	return nil, fmt.Errorf("method%v %w", r.Method, ErrMethodNotSupport)
+}
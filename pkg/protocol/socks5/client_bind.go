@@ -0,0 +1,126 @@
+package socks5
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// Listen 通过BIND在代理上监听,expectedPeer为预期的对端地址,为空时不限制
+// 返回的Listener只会产生一个连接
+func (c *Client) Listen(ctx context.Context, expectedPeer string) (l net.Listener, err error) {
+	if expectedPeer == "" {
+		expectedPeer = net.JoinHostPort(net.IPv4zero.String(), "0")
+	}
+	if expectedPeer, err = c.resolveAddress(ctx, expectedPeer); err != nil {
+		return
+	}
+	var re *ServerReply
+	conn, err := c.session(ctx, func(conn net.Conn) (err error) {
+		if err = c.handshake(ctx, conn, c.authenticators()); err != nil {
+			return
+		}
+		re, err = c.request(ctx, conn, CmdBIND, expectedPeer)
+		return
+	})
+	if err != nil {
+		return
+	}
+	addr := tcpAddr(relayAddress(re, conn.RemoteAddr()))
+	c.log.DebugF(ctx, "bind", addr)
+	return &bindListener{
+		conn: conn,
+		addr: addr,
+		second: func(r io.Reader) (string, error) {
+			re := NewServerReply()
+			if err := re.Decode(r); err != nil {
+				return "", err
+			}
+			if re.REP != RepSucceeded {
+				return "", &ReplyError{Code: re.REP, Proxy: c.serverAddress}
+			}
+			return re.GetAddress(), nil
+		},
+		closed: make(chan struct{}),
+	}, nil
+}
+
+// bindListener 第二次回复到达后产生唯一的连接
+type bindListener struct {
+	conn net.Conn
+	addr net.Addr
+	// second 读取第二次回复,返回入站对端的地址
+	second   func(r io.Reader) (string, error)
+	mu       sync.Mutex
+	started  bool
+	yielded  bool
+	isClosed bool
+	once     sync.Once
+	closed   chan struct{}
+}
+
+func (l *bindListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	if l.started {
+		l.mu.Unlock()
+		// 已经产生过连接,等待关闭
+		<-l.closed
+		return nil, net.ErrClosed
+	}
+	l.started = true
+	l.mu.Unlock()
+	remote, err := l.second(l.conn)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.isClosed {
+		return nil, net.ErrClosed
+	}
+	if err != nil {
+		_ = l.conn.Close()
+		return nil, err
+	}
+	l.yielded = true
+	return &bindConn{Conn: l.conn, remote: tcpAddr(remote)}, nil
+}
+
+// Close 未产生连接时关闭控制连接,已产生的连接由调用方关闭
+func (l *bindListener) Close() (err error) {
+	l.once.Do(func() {
+		close(l.closed)
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.isClosed = true
+		if !l.yielded {
+			err = l.conn.Close()
+		}
+	})
+	return
+}
+
+func (l *bindListener) Addr() net.Addr {
+	return l.addr
+}
+
+// bindConn RemoteAddr为入站对端的地址
+type bindConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *bindConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func tcpAddr(address string) net.Addr {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return &domainAddr{network: tcp, address: address}
+	}
+	port, _ := strconv.Atoi(portStr)
+	if ip := net.ParseIP(host); ip != nil {
+		return &net.TCPAddr{IP: ip, Port: port}
+	}
+	return &domainAddr{network: tcp, address: address}
+}
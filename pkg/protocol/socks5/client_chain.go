@@ -0,0 +1,97 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/matteo-gz/tyflo/pkg/logger"
+	"golang.org/x/net/proxy"
+)
+
+var (
+	ErrEmptyChain = errors.New("proxy chain is empty")
+)
+
+// ProxyError 记录出错的代理,多级代理时为实际失败的那一跳
+type ProxyError struct {
+	Proxy string
+	Err   error
+}
+
+func (e *ProxyError) Error() string {
+	return fmt.Sprintf("socks5 proxy %s: %v", e.Proxy, e.Err)
+}
+
+func (e *ProxyError) Unwrap() error {
+	return e.Err
+}
+
+// proxyError 已经由下一跳标记的错误原样返回
+func (c *Client) proxyError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var pe *ProxyError
+	if errors.As(err, &pe) {
+		return err
+	}
+	return &ProxyError{Proxy: c.serverAddress, Err: err}
+}
+
+// WithForward 通过d连接代理服务器,d可以是另一个Client、ssh隧道等
+func WithForward(d proxy.ContextDialer) ClientOption {
+	return func(c *Client) {
+		c.forward = d
+	}
+}
+
+// AsContextDialer 把服务端使用的Dialer(如ssh.Client)转为proxy.ContextDialer
+func AsContextDialer(d Dialer) proxy.ContextDialer {
+	return dialerAdapter{d: d}
+}
+
+type dialerAdapter struct {
+	d Dialer
+}
+
+func (a dialerAdapter) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case tcp, "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrNetworkNotSupport, network)
+	}
+	return a.d.DialContext(ctx, address)
+}
+
+// Hop 代理链中的一跳,User为空时不认证
+type Hop struct {
+	Address  string
+	User     string
+	Password string
+}
+
+// NewChain 创建依次经过hops的客户端,hops[0]为最先连接的代理
+// opts应用于每一跳,WithPool只对最后一跳生效
+func NewChain(l logger.Logger, hops []Hop, opts ...ClientOption) (*Client, error) {
+	if len(hops) == 0 {
+		return nil, ErrEmptyChain
+	}
+	var c *Client
+	for i, h := range hops {
+		o := append([]ClientOption{}, opts...)
+		if h.User != "" {
+			o = append(o, WithCredentials(h.User, h.Password))
+		}
+		if i < len(hops)-1 {
+			// 连接池只在最后一跳启用,由返回的Client负责关闭
+			o = append(o, withoutPool())
+		}
+		if c != nil {
+			o = append(o, WithForward(c))
+		}
+		c = NewClient(h.Address, l, o...)
+	}
+	return c, nil
+}
@@ -0,0 +1,145 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Phase 客户端握手阶段
+type Phase string
+
+const (
+	PhaseDial      Phase = "dial"
+	PhaseNegotiate Phase = "negotiate"
+	PhaseAuth      Phase = "auth"
+	PhaseRequest   Phase = "request"
+)
+
+// ErrProtocolViolation 服务端回复不符合协议,可用errors.Is判断
+var ErrProtocolViolation = errors.New("protocol violation")
+
+// protocolErrors 归类为协议错误的解码错误
+var protocolErrors = []error{
+	ErrVersionNotV5,
+	ErrBadVersion,
+	ErrRsvInvalid,
+	ErrATYPInvalid,
+	ErrMethodNotSupport,
+}
+
+// HandshakeError 握手某一阶段的错误
+type HandshakeError struct {
+	Phase Phase
+	Err   error
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("socks5 %s: %v", e.Phase, e.Err)
+}
+
+func (e *HandshakeError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout 实现net.Error,ctx超时或阶段超时时为true
+func (e *HandshakeError) Timeout() bool {
+	if errors.Is(e.Err, context.DeadlineExceeded) {
+		return true
+	}
+	var ne net.Error
+	return errors.As(e.Err, &ne) && ne.Timeout()
+}
+
+// Temporary 实现net.Error
+func (e *HandshakeError) Temporary() bool {
+	return e.Timeout()
+}
+
+func (e *HandshakeError) Is(target error) bool {
+	if target != ErrProtocolViolation {
+		return false
+	}
+	for _, pe := range protocolErrors {
+		if errors.Is(e.Err, pe) {
+			return true
+		}
+	}
+	return false
+}
+
+// WithPhaseTimeout 握手每个阶段(协商、认证、请求)的超时时间,与ctx的截止时间取较早者
+func WithPhaseTimeout(d time.Duration) ClientOption {
+	return func(c *Client) {
+		c.phaseTimeout = d
+	}
+}
+
+// session 连接代理服务器并在ctx约束下执行fn,ctx取消时关闭连接
+// fn成功后解除ctx对连接的约束,连接交给调用方
+func (c *Client) session(ctx context.Context, fn func(conn net.Conn) error) (conn net.Conn, err error) {
+	conn, err = c.dialServer(ctx)
+	if err != nil {
+		c.log.DebugF(ctx, "dial")
+		return nil, c.proxyError(c.phaseError(ctx, PhaseDial, err))
+	}
+	stop := guard(ctx, conn)
+	err = fn(conn)
+	if !stop() && err == nil {
+		// fn完成时ctx恰好取消,连接已被关闭
+		err = &HandshakeError{Phase: PhaseRequest, Err: ctx.Err()}
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, c.proxyError(err)
+	}
+	return conn, nil
+}
+
+// guard 设置ctx的截止时间,ctx取消时关闭连接;返回的stop在握手结束后调用
+func guard(ctx context.Context, conn net.Conn) (stop func() bool) {
+	if d, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(d)
+	}
+	stopClose := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	return func() bool {
+		stopped := stopClose()
+		if stopped {
+			_ = conn.SetDeadline(time.Time{})
+		}
+		return stopped
+	}
+}
+
+// phase 在阶段超时内执行fn,错误标记阶段
+func (c *Client) phase(ctx context.Context, conn net.Conn, p Phase, fn func() error) error {
+	if c.phaseTimeout > 0 {
+		deadline := time.Now().Add(c.phaseTimeout)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		if err := conn.SetDeadline(deadline); err != nil {
+			return c.phaseError(ctx, p, err)
+		}
+	}
+	return c.phaseError(ctx, p, fn())
+}
+
+// phaseError ctx已结束时以ctx的错误为准,已标记代理的错误原样返回
+func (c *Client) phaseError(ctx context.Context, p Phase, err error) error {
+	if err == nil {
+		return nil
+	}
+	var pe *ProxyError
+	if errors.As(err, &pe) {
+		return err
+	}
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return &HandshakeError{Phase: p, Err: err}
+}
@@ -0,0 +1,348 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/matteo-gz/tyflo/pkg/logger"
+	"golang.org/x/net/proxy"
+)
+
+var (
+	ErrNoEndpoints = errors.New("no proxy endpoints")
+)
+
+const (
+	backoffMin    = time.Second
+	backoffMax    = time.Minute
+	probeInterval = 30 * time.Second
+)
+
+var (
+	_ proxy.Dialer        = (*FailoverClient)(nil)
+	_ proxy.ContextDialer = (*FailoverClient)(nil)
+)
+
+// Strategy 选择代理的策略
+type Strategy int
+
+const (
+	// StrategyFailover 按配置顺序使用第一个可用的代理
+	StrategyFailover Strategy = iota
+	// StrategyRoundRobin 在可用的代理间轮询
+	StrategyRoundRobin
+	// StrategyLatency 优先使用探测到的握手延迟最低的代理
+	StrategyLatency
+)
+
+// Endpoint 一个代理服务器,User为空时不认证
+type Endpoint struct {
+	Address  string
+	User     string
+	Password string
+}
+
+// EndpointStatus 代理的当前状态
+type EndpointStatus struct {
+	Address string
+	// Up 为false时在DownUntil之前不会被优先选择
+	Up        bool
+	Failures  int
+	DownUntil time.Time
+	// Latency 探测到的握手延迟,未探测时为0
+	Latency time.Duration
+}
+
+type FailoverOption func(*FailoverClient)
+
+// WithStrategy 选择代理的策略,默认StrategyFailover
+func WithStrategy(s Strategy) FailoverOption {
+	return func(f *FailoverClient) {
+		f.strategy = s
+	}
+}
+
+// WithBackoff 连续失败后标记不可用的时长,从min开始每次翻倍,不超过max
+func WithBackoff(min, max time.Duration) FailoverOption {
+	return func(f *FailoverClient) {
+		f.backoffMin = min
+		f.backoffMax = max
+	}
+}
+
+// WithProbeInterval 后台探测的间隔,为0时不探测,默认30s
+func WithProbeInterval(d time.Duration) FailoverOption {
+	return func(f *FailoverClient) {
+		f.probeInterval = d
+	}
+}
+
+// WithEndpointOptions 创建每个代理的Client时使用的选项
+func WithEndpointOptions(opts ...ClientOption) FailoverOption {
+	return func(f *FailoverClient) {
+		f.clientOpts = append(f.clientOpts, opts...)
+	}
+}
+
+// FailoverClient 在多个代理间按策略选择,失败的代理按指数退避暂时跳过
+type FailoverClient struct {
+	log           logger.Logger
+	strategy      Strategy
+	backoffMin    time.Duration
+	backoffMax    time.Duration
+	probeInterval time.Duration
+	clientOpts    []ClientOption
+	endpoints     []*endpoint
+	next          atomic.Uint64
+	mu            sync.Mutex
+	done          chan struct{}
+	closeOnce     sync.Once
+}
+
+type endpoint struct {
+	client    *Client
+	failures  int
+	downUntil time.Time
+	latency   time.Duration
+}
+
+// NewFailoverClient 创建使用多个代理的客户端,使用后需调用Close停止探测
+func NewFailoverClient(l logger.Logger, endpoints []Endpoint, opts ...FailoverOption) (*FailoverClient, error) {
+	if len(endpoints) == 0 {
+		return nil, ErrNoEndpoints
+	}
+	f := &FailoverClient{
+		log:           l,
+		backoffMin:    backoffMin,
+		backoffMax:    backoffMax,
+		probeInterval: probeInterval,
+		done:          make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(f)
+	}
+	for _, e := range endpoints {
+		o := append([]ClientOption{}, f.clientOpts...)
+		if e.User != "" {
+			o = append(o, WithCredentials(e.User, e.Password))
+		}
+		f.endpoints = append(f.endpoints, &endpoint{client: NewClient(e.Address, l, o...)})
+	}
+	if f.probeInterval > 0 {
+		go f.probeLoop()
+	}
+	return f, nil
+}
+
+// Dial 实现proxy.Dialer
+func (f *FailoverClient) Dial(network, address string) (net.Conn, error) {
+	return f.DialContext(context.Background(), network, address)
+}
+
+// DialContext 实现proxy.ContextDialer,代理连接、协商、认证失败或超时时尝试下一个
+// 代理回复了失败码(如目标拒绝连接)或其他错误时直接返回,不标记代理不可用
+func (f *FailoverClient) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case tcp, "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrNetworkNotSupport, network)
+	}
+	if err := validAddress(address); err != nil {
+		return nil, err
+	}
+	var errs []error
+	for _, e := range f.pick() {
+		conn, err := e.client.DialContext(ctx, network, address)
+		if err == nil {
+			f.markUp(e)
+			return conn, nil
+		}
+		var re *ReplyError
+		if errors.As(err, &re) {
+			f.markUp(e)
+			return nil, err
+		}
+		if ctx.Err() != nil || !isProxyDown(err) {
+			// 如本地解析失败,换代理也不会成功
+			return nil, err
+		}
+		f.log.DebugF(ctx, "failover", e.client.serverAddress, err)
+		f.markDown(e)
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// validAddress 目标地址无法编码为请求时不必尝试任何代理
+func validAddress(address string) error {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if _, err = strconv.ParseUint(port, 10, 16); err != nil {
+		return err
+	}
+	return NewClientRequest().SetCmdConnect(address)
+}
+
+// isProxyDown 连接、协商、认证失败或超时说明代理不可用
+func isProxyDown(err error) bool {
+	var he *HandshakeError
+	if errors.As(err, &he) {
+		switch he.Phase {
+		case PhaseDial, PhaseNegotiate, PhaseAuth:
+			return true
+		}
+	}
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// Endpoints 返回各代理的状态,顺序与创建时一致
+func (f *FailoverClient) Endpoints() []EndpointStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	status := make([]EndpointStatus, len(f.endpoints))
+	for i, e := range f.endpoints {
+		status[i] = EndpointStatus{
+			Address:   e.client.serverAddress,
+			Up:        !now.Before(e.downUntil),
+			Failures:  e.failures,
+			DownUntil: e.downUntil,
+			Latency:   e.latency,
+		}
+	}
+	return status
+}
+
+// Close 停止探测并关闭各代理Client的连接池
+func (f *FailoverClient) Close() error {
+	f.closeOnce.Do(func() {
+		close(f.done)
+	})
+	var errs []error
+	for _, e := range f.endpoints {
+		errs = append(errs, e.client.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// pick 按策略排列可用的代理,全部不可用时按恢复时间排列全部代理
+func (f *FailoverClient) pick() []*endpoint {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	var up, down []*endpoint
+	for _, e := range f.endpoints {
+		if now.Before(e.downUntil) {
+			down = append(down, e)
+		} else {
+			up = append(up, e)
+		}
+	}
+	if len(up) == 0 {
+		sort.SliceStable(down, func(i, j int) bool {
+			return down[i].downUntil.Before(down[j].downUntil)
+		})
+		return down
+	}
+	switch f.strategy {
+	case StrategyRoundRobin:
+		n := int(f.next.Add(1)-1) % len(up)
+		up = append(up[n:], up[:n]...)
+	case StrategyLatency:
+		// 未探测过的代理排在后面
+		sort.SliceStable(up, func(i, j int) bool {
+			li, lj := up[i].latency, up[j].latency
+			if li == 0 || lj == 0 {
+				return lj == 0 && li != 0
+			}
+			return li < lj
+		})
+	}
+	return up
+}
+
+func (f *FailoverClient) markUp(e *endpoint) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e.failures = 0
+	e.downUntil = time.Time{}
+}
+
+func (f *FailoverClient) markDown(e *endpoint) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	backoff := f.backoffMin << e.failures
+	if backoff > f.backoffMax || backoff <= 0 {
+		backoff = f.backoffMax
+	}
+	e.failures++
+	e.downUntil = time.Now().Add(backoff)
+}
+
+func (f *FailoverClient) probeLoop() {
+	f.probe()
+	t := time.NewTicker(f.probeInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-f.done:
+			return
+		case <-t.C:
+			f.probe()
+		}
+	}
+}
+
+// probe 并发探测所有代理,完成握手即视为可用
+func (f *FailoverClient) probe() {
+	var wg sync.WaitGroup
+	for _, e := range f.endpoints {
+		wg.Add(1)
+		go func(e *endpoint) {
+			defer wg.Done()
+			latency, err := e.client.probe()
+			if err != nil {
+				f.log.DebugF(context.Background(), "probe", e.client.serverAddress, err)
+				f.markDown(e)
+				return
+			}
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			e.failures = 0
+			e.downUntil = time.Time{}
+			if e.latency == 0 {
+				e.latency = latency
+			} else {
+				// 平滑单次探测的抖动
+				e.latency = (e.latency*7 + latency*3) / 10
+			}
+		}(e)
+	}
+	wg.Wait()
+}
+
+// probe 完成一次协商和认证,返回耗时
+func (c *Client) probe() (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.dialTimeout)
+	defer cancel()
+	start := time.Now()
+	conn, err := c.session(ctx, func(conn net.Conn) error {
+		return c.handshake(ctx, conn, c.authenticators())
+	})
+	if err != nil {
+		return 0, err
+	}
+	latency := time.Since(start)
+	_ = conn.Close()
+	return latency, nil
+}
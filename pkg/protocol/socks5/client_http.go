@@ -0,0 +1,19 @@
+package socks5
+
+import "net/http"
+
+// Transport 返回通过代理拨号的http.Transport,其余配置与http.DefaultTransport一致
+func (c *Client) Transport() *http.Transport {
+	t := &http.Transport{}
+	if dt, ok := http.DefaultTransport.(*http.Transport); ok {
+		t = dt.Clone()
+	}
+	t.Proxy = nil
+	t.DialContext = c.DialContext
+	return t
+}
+
+// RoundTripper 返回通过代理拨号的http.RoundTripper
+func (c *Client) RoundTripper() http.RoundTripper {
+	return c.Transport()
+}
@@ -0,0 +1,126 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// errPipelineFallback 服务端选择了预期之外的方法,需要重新按步骤握手
+var errPipelineFallback = errors.New("pipeline fallback")
+
+// WithPipeline 尽量一次写入协商、认证和CONNECT请求,再按顺序读取回复,提供的方法与逐步握手相同
+// 服务端选择了预期之外的方法时,重新建立连接按步骤握手
+func WithPipeline() ClientOption {
+	return func(c *Client) {
+		c.pipeline = true
+	}
+}
+
+// connectPipelined 提供与逐步握手相同的方法
+// 只有一个方法时一次写出协商、认证和CONNECT,并预期服务端选择它
+// 有多个方法时先等服务端选择,再一次写出认证和CONNECT,保证选择的结果与逐步握手一致
+// 无认证和用户名密码认证的子协商才能提前写出
+func (c *Client) connectPipelined(ctx context.Context, address string, auths []ClientAuthenticator) (conn net.Conn, err error) {
+	req := NewClientRequest()
+	if err = req.SetCmdConnect(address); err != nil {
+		return
+	}
+	trace := ContextClientTrace(ctx)
+	if len(auths) > 1 {
+		return c.session(ctx, func(conn net.Conn) error {
+			var a ClientAuthenticator
+			if err := c.phase(ctx, conn, PhaseNegotiate, func() (err error) {
+				a, err = c.negotiate(conn, auths)
+				return
+			}); err != nil {
+				return err
+			}
+			trace.methodSelected(a.Method())
+			data, ok, err := pipelineAuth(a)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				// 子协商无法提前写出,按步骤完成
+				trace.authStart(a.Method())
+				err := c.phase(ctx, conn, PhaseAuth, func() error {
+					return a.Authenticate(ctx, conn)
+				})
+				trace.authDone(a.Method(), err)
+				if err != nil {
+					return err
+				}
+				return c.handleRequest(ctx, conn, address)
+			}
+			if _, err := conn.Write(append(data, req.Bytes()...)); err != nil {
+				return c.phaseError(ctx, PhaseRequest, err)
+			}
+			trace.connectRequestSent(address)
+			return c.pipelineReplies(ctx, conn, a)
+		})
+	}
+	a := auths[0]
+	method := a.Method()
+	auth, ok, err := pipelineAuth(a)
+	if err != nil {
+		return
+	}
+	if !ok {
+		return nil, errPipelineFallback
+	}
+	greeting := NewClientNegotiateReq()
+	greeting.SetMethods(method)
+	data := append(greeting.Bytes(), auth...)
+	data = append(data, req.Bytes()...)
+	return c.session(ctx, func(conn net.Conn) error {
+		if err := c.phase(ctx, conn, PhaseNegotiate, func() error {
+			if _, err := conn.Write(data); err != nil {
+				return err
+			}
+			trace.connectRequestSent(address)
+			r := NewServerNegotiateReply()
+			if err := r.Decode(conn); err != nil {
+				return err
+			}
+			if r.Method != method {
+				c.log.DebugF(ctx, "pipeline unexpected method", r.Method)
+				return errPipelineFallback
+			}
+			trace.methodSelected(method)
+			return nil
+		}); err != nil {
+			return err
+		}
+		return c.pipelineReplies(ctx, conn, a)
+	})
+}
+
+// pipelineAuth 返回可以提前写出的子协商,方法不支持提前写出时ok为false
+func pipelineAuth(a ClientAuthenticator) (data []byte, ok bool, err error) {
+	if userPass, isUserPass := a.(*UserPassAuth); isUserPass {
+		data, err = userPass.request()
+		return data, err == nil, err
+	}
+	return nil, a.Method() == MethodNoAuthenticationRequired, nil
+}
+
+// pipelineReplies 按顺序读取子协商和CONNECT的回复
+func (c *Client) pipelineReplies(ctx context.Context, conn net.Conn, a ClientAuthenticator) error {
+	trace := ContextClientTrace(ctx)
+	if _, ok := a.(*UserPassAuth); ok {
+		trace.authStart(a.Method())
+		err := c.phase(ctx, conn, PhaseAuth, func() error {
+			return NewUsernamePasswordReply().Decode(conn)
+		})
+		trace.authDone(a.Method(), err)
+		if err != nil {
+			return err
+		}
+	}
+	return c.phase(ctx, conn, PhaseRequest, func() error {
+		re, err := c.readReply(conn)
+		trace.connectReplyReceived(re, err)
+		return err
+	})
+}
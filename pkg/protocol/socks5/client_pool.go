@@ -0,0 +1,271 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	poolProbeTimeout = time.Millisecond
+	// 服务端默认在握手开始30s后仍未收到请求时断开,池中连接需在此之前淘汰
+	poolMaxAge       = 20 * time.Second
+	poolReapInterval = 10 * time.Second
+)
+
+// PoolConfig 预先完成协商和认证的连接池配置,连接使用Client配置的凭据
+// 空闲连接在服务端看来仍处于握手阶段,MaxAge需小于服务端的握手超时
+type PoolConfig struct {
+	// MaxIdle 保持的空闲连接数
+	MaxIdle int
+	// MaxAge 连接建立后的最长保留时间,为0时默认20s,小于0时不限制
+	MaxAge time.Duration
+	// ReapInterval 后台清理过期和失效连接的间隔,为0时默认10s
+	ReapInterval time.Duration
+}
+
+// PoolStats 连接池指标
+type PoolStats struct {
+	Hits    uint64
+	Misses  uint64
+	Stale   uint64
+	Expired uint64
+	Idle    int
+}
+
+// HitRate 命中率
+func (s PoolStats) HitRate() float64 {
+	total := s.Hits + s.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(total)
+}
+
+// WithPool 启用预认证连接池,Dial时只需发送CONNECT请求,使用后需调用Client.Close
+func WithPool(cfg PoolConfig) ClientOption {
+	return func(c *Client) {
+		c.poolConfig = &cfg
+	}
+}
+
+// withoutPool 取消WithPool,用于代理链中无法被Close的中间跳
+func withoutPool() ClientOption {
+	return func(c *Client) {
+		c.poolConfig = nil
+	}
+}
+
+type pooledConn struct {
+	conn    net.Conn
+	created time.Time
+}
+
+type connPool struct {
+	c       *Client
+	cfg     PoolConfig
+	mu      sync.Mutex
+	idle    []pooledConn
+	filling int
+	closed  bool
+	done    chan struct{}
+
+	hits    atomic.Uint64
+	misses  atomic.Uint64
+	stale   atomic.Uint64
+	expired atomic.Uint64
+}
+
+func newConnPool(c *Client, cfg PoolConfig) *connPool {
+	if cfg.MaxAge == 0 {
+		cfg.MaxAge = poolMaxAge
+	}
+	if cfg.ReapInterval <= 0 {
+		cfg.ReapInterval = poolReapInterval
+	}
+	p := &connPool{
+		c:    c,
+		cfg:  cfg,
+		done: make(chan struct{}),
+	}
+	p.refill()
+	go p.reap()
+	return p
+}
+
+// get 取出一个可用的连接,没有时返回nil
+func (p *connPool) get() net.Conn {
+	defer p.refill()
+	for {
+		p.mu.Lock()
+		n := len(p.idle)
+		if n == 0 {
+			p.mu.Unlock()
+			p.misses.Add(1)
+			return nil
+		}
+		pc := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		if p.isExpired(pc) {
+			p.expired.Add(1)
+			_ = pc.conn.Close()
+			continue
+		}
+		if !isAlive(pc.conn) {
+			p.stale.Add(1)
+			_ = pc.conn.Close()
+			continue
+		}
+		p.hits.Add(1)
+		return pc.conn
+	}
+}
+
+// markStale 取出的连接发送请求失败,改记为失效
+func (p *connPool) markStale() {
+	p.hits.Add(^uint64(0))
+	p.stale.Add(1)
+}
+
+func (p *connPool) isExpired(pc pooledConn) bool {
+	return p.cfg.MaxAge > 0 && time.Since(pc.created) > p.cfg.MaxAge
+}
+
+// isAlive 空闲连接上不应有数据,读超时说明连接仍然可用
+func isAlive(conn net.Conn) bool {
+	if err := conn.SetReadDeadline(time.Now().Add(poolProbeTimeout)); err != nil {
+		return false
+	}
+	n, err := conn.Read(make([]byte, 1))
+	if n > 0 || !errors.Is(err, os.ErrDeadlineExceeded) {
+		return false
+	}
+	return conn.SetReadDeadline(time.Time{}) == nil
+}
+
+// refill 后台补充空闲连接到MaxIdle
+func (p *connPool) refill() {
+	p.mu.Lock()
+	need := p.cfg.MaxIdle - len(p.idle) - p.filling
+	if p.closed || need <= 0 {
+		p.mu.Unlock()
+		return
+	}
+	p.filling += need
+	p.mu.Unlock()
+	for i := 0; i < need; i++ {
+		go p.fill()
+	}
+}
+
+func (p *connPool) fill() {
+	ctx, cancel := context.WithTimeout(context.Background(), p.c.dialTimeout)
+	defer cancel()
+	conn, err := p.c.session(ctx, func(conn net.Conn) error {
+		return p.c.handshake(ctx, conn, p.c.authenticators())
+	})
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.filling--
+	if err != nil {
+		p.c.log.DebugF(ctx, "pool fill", err)
+		return
+	}
+	if p.closed || len(p.idle) >= p.cfg.MaxIdle {
+		_ = conn.Close()
+		return
+	}
+	p.idle = append(p.idle, pooledConn{conn: conn, created: time.Now()})
+}
+
+// reap 定期清理过期和失效的空闲连接
+func (p *connPool) reap() {
+	t := time.NewTicker(p.cfg.ReapInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-t.C:
+		}
+		p.mu.Lock()
+		idle := p.idle
+		p.idle = nil
+		p.mu.Unlock()
+		var keep []pooledConn
+		for _, pc := range idle {
+			switch {
+			case p.isExpired(pc):
+				p.expired.Add(1)
+				_ = pc.conn.Close()
+			case !isAlive(pc.conn):
+				p.stale.Add(1)
+				_ = pc.conn.Close()
+			default:
+				keep = append(keep, pc)
+			}
+		}
+		p.mu.Lock()
+		if p.closed {
+			// 检查期间连接池已关闭
+			p.mu.Unlock()
+			for _, pc := range keep {
+				_ = pc.conn.Close()
+			}
+			return
+		}
+		p.idle = append(p.idle, keep...)
+		p.mu.Unlock()
+		p.refill()
+	}
+}
+
+func (p *connPool) stats() PoolStats {
+	p.mu.Lock()
+	idle := len(p.idle)
+	p.mu.Unlock()
+	return PoolStats{
+		Hits:    p.hits.Load(),
+		Misses:  p.misses.Load(),
+		Stale:   p.stale.Load(),
+		Expired: p.expired.Load(),
+		Idle:    idle,
+	}
+}
+
+func (p *connPool) close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	close(p.done)
+	var errs []error
+	for _, pc := range p.idle {
+		errs = append(errs, pc.conn.Close())
+	}
+	p.idle = nil
+	return errors.Join(errs...)
+}
+
+// PoolStats 未启用连接池时返回零值
+func (c *Client) PoolStats() PoolStats {
+	if c.pool == nil {
+		return PoolStats{}
+	}
+	return c.pool.stats()
+}
+
+// Close 关闭连接池中的空闲连接,已经Dial出的连接不受影响
+func (c *Client) Close() error {
+	if c.pool == nil {
+		return nil
+	}
+	return c.pool.close()
+}
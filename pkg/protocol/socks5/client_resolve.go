@@ -0,0 +1,57 @@
+package socks5
+
+import (
+	"context"
+	"net"
+)
+
+// ResolveMode 客户端对目标域名的解析方式
+type ResolveMode int
+
+const (
+	// ResolveRemote 域名交给代理解析,即socks5h://
+	ResolveRemote ResolveMode = iota
+	// ResolveLocal 本地解析后发送IP,即socks5://
+	ResolveLocal
+	// ResolveLocalFallback 本地解析,失败时交给代理解析
+	ResolveLocalFallback
+)
+
+// WithResolveMode 设置目标域名的解析方式,对CONNECT、BIND的预期对端和UDP目标都生效
+// r为nil时使用net.DefaultResolver
+func WithResolveMode(mode ResolveMode, r *net.Resolver) ClientOption {
+	return func(c *Client) {
+		c.resolveMode = mode
+		c.resolver = r
+	}
+}
+
+// resolveAddress 按解析方式把address中的域名换成IP
+func (c *Client) resolveAddress(ctx context.Context, address string) (string, error) {
+	if c.resolveMode == ResolveRemote {
+		return address, nil
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+	if net.ParseIP(host) != nil {
+		return address, nil
+	}
+	r := c.resolver
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	ips, err := r.LookupIP(ctx, "ip", host)
+	if err == nil && len(ips) == 0 {
+		err = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	if err != nil {
+		if c.resolveMode == ResolveLocalFallback {
+			c.log.DebugF(ctx, "local resolve fallback", host, err)
+			return address, nil
+		}
+		return "", err
+	}
+	return net.JoinHostPort(ips[0].String(), port), nil
+}
@@ -0,0 +1,100 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/matteo-gz/tyflo/pkg/logger"
+)
+
+// NewSocks4Client 创建新的SOCKS4客户端,域名使用4a格式由代理解析
+func NewSocks4Client(serverAddress, userID string, l logger.Logger) *Socks4Client {
+	return &Socks4Client{serverAddress: serverAddress, userID: userID, log: l}
+}
+
+// Socks4Client SOCKS4/4a客户端结构体
+type Socks4Client struct {
+	serverAddress string
+	userID        string
+	log           logger.Logger
+}
+
+// Dial 实现proxy.Dialer
+func (c *Socks4Client) Dial(network, address string) (net.Conn, error) {
+	return c.DialContext(context.Background(), network, address)
+}
+
+// DialContext 建立SOCKS4连接
+func (c *Socks4Client) DialContext(ctx context.Context, network, address string) (conn net.Conn, err error) {
+	switch network {
+	case tcp, "tcp4":
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrNetworkNotSupport, network)
+	}
+	conn, _, err = c.session(ctx, CmdCONNECT, address)
+	return
+}
+
+// Listen 通过BIND在代理上监听,expectedPeer为预期的对端地址,为空时不限制
+// 返回的Listener只会产生一个连接
+func (c *Socks4Client) Listen(ctx context.Context, expectedPeer string) (net.Listener, error) {
+	if expectedPeer == "" {
+		expectedPeer = net.JoinHostPort(net.IPv4zero.String(), "0")
+	}
+	conn, re, err := c.session(ctx, CmdBIND, expectedPeer)
+	if err != nil {
+		return nil, err
+	}
+	addr := re.GetAddress()
+	if re.DSTIP.IsUnspecified() {
+		// 回复0.0.0.0时使用代理服务器的地址
+		if host, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil {
+			addr = net.JoinHostPort(host, strconv.Itoa(int(re.DSTPort)))
+		}
+	}
+	c.log.DebugF(ctx, "socks4 bind", addr)
+	return &bindListener{
+		conn: conn,
+		addr: tcpAddr(addr),
+		second: func(r io.Reader) (string, error) {
+			re := NewSocks4Reply()
+			if err := re.Decode(r); err != nil {
+				return "", err
+			}
+			return re.GetAddress(), nil
+		},
+		closed: make(chan struct{}),
+	}, nil
+}
+
+// session 发送请求并读取第一次回复,ctx取消或超时时关闭连接
+func (c *Socks4Client) session(ctx context.Context, cmd byte, address string) (conn net.Conn, re *Socks4Reply, err error) {
+	req := NewSocks4Request()
+	if err = req.SetCmd(cmd, address, c.userID); err != nil {
+		return
+	}
+	if conn, err = dial(ctx, c.serverAddress); err != nil {
+		return
+	}
+	stop := guard(ctx, conn)
+	re = NewSocks4Reply()
+	if _, err = conn.Write(req.Bytes()); err == nil {
+		err = re.Decode(conn)
+	}
+	if !stop() && err == nil {
+		// 读完回复时ctx恰好取消,连接已被关闭
+		err = ctx.Err()
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		c.log.DebugF(ctx, "socks4 reply", err)
+		_ = conn.Close()
+		return nil, nil, err
+	}
+	return conn, re, nil
+}
@@ -0,0 +1,93 @@
+package socks5
+
+import (
+	"context"
+)
+
+// ClientTrace 客户端握手各阶段的回调,用法与httptrace类似,字段均可为nil
+// 多级代理时只有最后一跳触发,ProxyDialStart/ProxyDialDone包含经由前面各跳连接的耗时
+// 从连接池取出的连接只触发ConnectRequestSent/ConnectReplyReceived/HandshakeDone
+type ClientTrace struct {
+	// ProxyDialStart 开始连接代理服务器
+	ProxyDialStart func(proxy string)
+	// ProxyDialDone 与代理服务器的连接建立完成
+	ProxyDialDone func(proxy string, err error)
+	// MethodSelected 收到服务端选择的认证方法
+	MethodSelected func(method byte)
+	// AuthStart 开始子协商
+	AuthStart func(method byte)
+	// AuthDone 子协商完成
+	AuthDone func(method byte, err error)
+	// ConnectRequestSent CONNECT请求已写出
+	ConnectRequestSent func(address string)
+	// ConnectReplyReceived 收到CONNECT回复,bound为代理绑定的地址,读取失败时为空
+	ConnectReplyReceived func(bound string, err error)
+	// HandshakeDone Dial完成,连接可以使用或已失败
+	HandshakeDone func(err error)
+}
+
+type clientTraceKey struct{}
+
+// WithClientTrace 返回携带trace的ctx,用于Dial/DialContext
+func WithClientTrace(ctx context.Context, trace *ClientTrace) context.Context {
+	return context.WithValue(ctx, clientTraceKey{}, trace)
+}
+
+// ContextClientTrace 返回ctx中的trace,没有时为nil
+func ContextClientTrace(ctx context.Context) *ClientTrace {
+	trace, _ := ctx.Value(clientTraceKey{}).(*ClientTrace)
+	return trace
+}
+
+func (t *ClientTrace) proxyDialStart(proxy string) {
+	if t != nil && t.ProxyDialStart != nil {
+		t.ProxyDialStart(proxy)
+	}
+}
+
+func (t *ClientTrace) proxyDialDone(proxy string, err error) {
+	if t != nil && t.ProxyDialDone != nil {
+		t.ProxyDialDone(proxy, err)
+	}
+}
+
+func (t *ClientTrace) methodSelected(method byte) {
+	if t != nil && t.MethodSelected != nil {
+		t.MethodSelected(method)
+	}
+}
+
+func (t *ClientTrace) authStart(method byte) {
+	if t != nil && t.AuthStart != nil {
+		t.AuthStart(method)
+	}
+}
+
+func (t *ClientTrace) authDone(method byte, err error) {
+	if t != nil && t.AuthDone != nil {
+		t.AuthDone(method, err)
+	}
+}
+
+func (t *ClientTrace) connectRequestSent(address string) {
+	if t != nil && t.ConnectRequestSent != nil {
+		t.ConnectRequestSent(address)
+	}
+}
+
+func (t *ClientTrace) connectReplyReceived(re *ServerReply, err error) {
+	if t == nil || t.ConnectReplyReceived == nil {
+		return
+	}
+	var bound string
+	if re != nil {
+		bound = re.GetAddress()
+	}
+	t.ConnectReplyReceived(bound, err)
+}
+
+func (t *ClientTrace) handshakeDone(err error) {
+	if t != nil && t.HandshakeDone != nil {
+		t.HandshakeDone(err)
+	}
+}
@@ -0,0 +1,153 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ListenPacket 通过UDP ASSOCIATE建立UDP中继,控制连接断开时关闭
+func (c *Client) ListenPacket(ctx context.Context) (pc net.PacketConn, err error) {
+	var re *ServerReply
+	ctrl, err := c.session(ctx, func(conn net.Conn) (err error) {
+		if err = c.handshake(ctx, conn, c.authenticators()); err != nil {
+			return
+		}
+		re, err = c.request(ctx, conn, CmdUDPAssociate, net.JoinHostPort(net.IPv4zero.String(), "0"))
+		return
+	})
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = ctrl.Close()
+		}
+	}()
+	relay, err := net.ResolveUDPAddr(udp, relayAddress(re, ctrl.RemoteAddr()))
+	if err != nil {
+		return
+	}
+	conn, err := net.DialUDP(udp, nil, relay)
+	if err != nil {
+		return
+	}
+	c.log.DebugF(ctx, "udp associate", conn.LocalAddr(), relay)
+	u := &udpPacketConn{ctrl: ctrl, conn: conn, resolve: c.resolveAddress}
+	go u.watch()
+	return u, nil
+}
+
+// relayAddress 回复的绑定地址为0.0.0.0时使用代理服务器的地址
+func relayAddress(re *ServerReply, server net.Addr) string {
+	if ip := net.ParseIP(re.host); ip == nil || !ip.IsUnspecified() {
+		return re.GetAddress()
+	}
+	host, _, err := net.SplitHostPort(server.String())
+	if err != nil {
+		return re.GetAddress()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(re.BNDPort)))
+}
+
+// udpPacketConn 收发时封装/解析SOCKS5 UDP头
+type udpPacketConn struct {
+	ctrl    net.Conn
+	conn    *net.UDPConn
+	resolve func(ctx context.Context, address string) (string, error)
+	once    sync.Once
+	rmu     sync.Mutex
+	rbuf    []byte
+}
+
+// watch 控制连接断开后关闭UDP中继
+func (u *udpPacketConn) watch() {
+	_, _ = io.Copy(io.Discard, u.ctrl)
+	_ = u.Close()
+}
+
+func (u *udpPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	u.rmu.Lock()
+	defer u.rmu.Unlock()
+	if u.rbuf == nil {
+		u.rbuf = make([]byte, udpBufSize)
+	}
+	for {
+		var m int
+		m, err = u.conn.Read(u.rbuf)
+		if err != nil {
+			return
+		}
+		d := NewUDPDatagram()
+		if d.Decode(bytes.NewReader(u.rbuf[:m])) != nil || d.FRAG != 0 {
+			continue
+		}
+		n = copy(p, d.Data)
+		return n, datagramAddr(d), nil
+	}
+}
+
+// WriteTo addr可以是任意host:port形式的地址,域名按WithResolveMode解析
+func (u *udpPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	address, err := u.resolve(context.Background(), addr.String())
+	if err != nil {
+		return
+	}
+	d := NewUDPDatagram()
+	if err = d.SetData(address, p); err != nil {
+		return
+	}
+	if _, err = u.conn.Write(d.Bytes()); err != nil {
+		return
+	}
+	return len(p), nil
+}
+
+func (u *udpPacketConn) Close() (err error) {
+	u.once.Do(func() {
+		_ = u.ctrl.Close()
+		err = u.conn.Close()
+	})
+	return
+}
+
+func (u *udpPacketConn) LocalAddr() net.Addr {
+	return u.conn.LocalAddr()
+}
+
+func (u *udpPacketConn) SetDeadline(t time.Time) error {
+	return u.conn.SetDeadline(t)
+}
+
+func (u *udpPacketConn) SetReadDeadline(t time.Time) error {
+	return u.conn.SetReadDeadline(t)
+}
+
+func (u *udpPacketConn) SetWriteDeadline(t time.Time) error {
+	return u.conn.SetWriteDeadline(t)
+}
+
+func datagramAddr(d *UDPDatagram) net.Addr {
+	if d.ATYP == ATYPDomainName {
+		return &domainAddr{network: udp, address: d.GetAddress()}
+	}
+	return &net.UDPAddr{IP: net.IP(d.DSTAddr), Port: int(d.DSTPort)}
+}
+
+// domainAddr 未解析的域名地址
+type domainAddr struct {
+	network string
+	address string
+}
+
+func (a *domainAddr) Network() string {
+	return a.network
+}
+
+func (a *domainAddr) String() string {
+	return a.address
+}
@@ -0,0 +1,194 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/matteo-gz/tyflo/pkg/logger"
+	"golang.org/x/net/proxy"
+)
+
+var (
+	ErrSchemeNotSupport = errors.New("proxy scheme not support")
+)
+
+const (
+	defaultPort = "1080"
+)
+
+var _ proxy.ContextDialer = (*EnvDialer)(nil)
+
+// proxyEnvs 按顺序查找,与curl一致
+var proxyEnvs = []string{
+	"ALL_PROXY", "all_proxy",
+	"SOCKS_PROXY", "socks_proxy",
+	"HTTPS_PROXY", "https_proxy",
+}
+
+// NewClientFromURL socks5://本地解析域名,socks5h://由代理解析,端口默认1080
+func NewClientFromURL(u *url.URL, l logger.Logger, opts ...ClientOption) (*Client, error) {
+	var o []ClientOption
+	switch u.Scheme {
+	case "socks5":
+		o = append(o, WithResolveMode(ResolveLocal, nil))
+	case "socks5h":
+		o = append(o, WithResolveMode(ResolveRemote, nil))
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrSchemeNotSupport, u.Scheme)
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		o = append(o, WithCredentials(u.User.Username(), password))
+	}
+	address := u.Host
+	if u.Port() == "" {
+		address = net.JoinHostPort(u.Hostname(), defaultPort)
+	}
+	return NewClient(address, l, append(o, opts...)...), nil
+}
+
+// EnvDialer 按环境变量选择代理,NO_PROXY命中或没有配置代理时直连
+type EnvDialer struct {
+	client  *Client
+	noProxy []noProxyRule
+	direct  *net.Dialer
+}
+
+// NewFromEnvironment 从ALL_PROXY/SOCKS_PROXY/HTTPS_PROXY读取socks5代理,并遵循NO_PROXY
+// ALL_PROXY/SOCKS_PROXY不是socks5代理时返回ErrSchemeNotSupport,HTTPS_PROXY不是时忽略
+func NewFromEnvironment(l logger.Logger, opts ...ClientOption) (*EnvDialer, error) {
+	d := &EnvDialer{
+		noProxy: parseNoProxy(getEnv("NO_PROXY", "no_proxy")),
+		direct: &net.Dialer{
+			Timeout:   dialTimeout,
+			KeepAlive: keepAlive,
+		},
+	}
+	for _, name := range proxyEnvs {
+		v := os.Getenv(name)
+		if v == "" {
+			continue
+		}
+		u, err := url.Parse(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		if u.Scheme != "socks5" && u.Scheme != "socks5h" && strings.EqualFold(name, "HTTPS_PROXY") {
+			// 例如HTTPS_PROXY=http://...,是给http客户端的代理
+			continue
+		}
+		if d.client, err = NewClientFromURL(u, l, opts...); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		break
+	}
+	return d, nil
+}
+
+// Dial 实现proxy.Dialer
+func (d *EnvDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext 实现proxy.ContextDialer
+func (d *EnvDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if d.client == nil || d.bypass(address) {
+		return d.direct.DialContext(ctx, network, address)
+	}
+	return d.client.DialContext(ctx, network, address)
+}
+
+// Client 没有配置代理时为nil
+func (d *EnvDialer) Client() *Client {
+	return d.client
+}
+
+func (d *EnvDialer) bypass(address string) bool {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	ip := net.ParseIP(host)
+	for _, r := range d.noProxy {
+		if r.match(host, ip, port) {
+			return true
+		}
+	}
+	return false
+}
+
+func getEnv(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// noProxyRule NO_PROXY中的一项
+// *匹配全部;CIDR和IP匹配IP目标;foo.com和.foo.com都匹配自身及子域名(与curl一致);可带端口
+type noProxyRule struct {
+	all    bool
+	ipNet  *net.IPNet
+	ip     net.IP
+	domain string
+	port   string
+}
+
+func parseNoProxy(v string) (rules []noProxyRule) {
+	for _, p := range strings.FieldsFunc(v, func(r rune) bool {
+		return r == ',' || r == ' '
+	}) {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if p == "" {
+			continue
+		}
+		if p == "*" {
+			return []noProxyRule{{all: true}}
+		}
+		if _, ipNet, err := net.ParseCIDR(p); err == nil {
+			rules = append(rules, noProxyRule{ipNet: ipNet})
+			continue
+		}
+		var r noProxyRule
+		if host, port, err := net.SplitHostPort(p); err == nil {
+			p = host
+			r.port = port
+		}
+		if ip := net.ParseIP(strings.Trim(p, "[]")); ip != nil {
+			r.ip = ip
+			rules = append(rules, r)
+			continue
+		}
+		p = strings.TrimPrefix(p, "*")
+		r.domain = strings.TrimSuffix(strings.TrimPrefix(p, "."), ".")
+		rules = append(rules, r)
+	}
+	return
+}
+
+func (r noProxyRule) match(host string, ip net.IP, port string) bool {
+	if r.all {
+		return true
+	}
+	if r.port != "" && r.port != port {
+		return false
+	}
+	switch {
+	case r.ipNet != nil:
+		return ip != nil && r.ipNet.Contains(ip)
+	case r.ip != nil:
+		return ip != nil && r.ip.Equal(ip)
+	case ip != nil:
+		return false
+	default:
+		return host == r.domain || strings.HasSuffix(host, "."+r.domain)
+	}
+}
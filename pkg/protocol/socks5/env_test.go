@@ -0,0 +1,43 @@
+package socks5
+
+import "testing"
+
+func TestEnvDialerBypass(t *testing.T) {
+	tests := []struct {
+		noProxy string
+		address string
+		want    bool
+	}{
+		{"", "example.com:80", false},
+		{"*", "example.com:80", true},
+		{"*", "10.0.0.1:443", true},
+		{"example.com", "example.com:80", true},
+		{"example.com", "www.example.com:80", true},
+		{"example.com", "badexample.com:80", false},
+		{".example.com", "example.com:80", true},
+		{".example.com", "www.example.com:80", true},
+		{".example.com", "badexample.com:80", false},
+		{"*.example.com", "www.example.com:80", true},
+		{"EXAMPLE.com", "Example.COM.:80", true},
+		{"example.com:8080", "example.com:8080", true},
+		{"example.com:8080", "example.com:80", false},
+		{"10.0.0.0/8", "10.1.2.3:80", true},
+		{"10.0.0.0/8", "11.1.2.3:80", false},
+		{"10.0.0.0/8", "example.com:80", false},
+		{"192.168.1.1", "192.168.1.1:22", true},
+		{"192.168.1.1:22", "192.168.1.1:80", false},
+		{"::1", "[::1]:80", true},
+		{"[::1]:80", "[::1]:80", true},
+		{"[::1]:80", "[::1]:81", false},
+		{"fd00::/8", "[fd12::1]:80", true},
+		{"fd00::/8", "[fe80::1]:80", false},
+		{"localhost, .internal", "db.internal:5432", true},
+		{"localhost, .internal", "example.com:80", false},
+	}
+	for _, tt := range tests {
+		d := &EnvDialer{noProxy: parseNoProxy(tt.noProxy)}
+		if got := d.bypass(tt.address); got != tt.want {
+			t.Errorf("NO_PROXY=%q bypass(%q) = %v, want %v", tt.noProxy, tt.address, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package socks5
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+var (
+	ErrGeneralFailure = errors.New("general SOCKS server failure")
+	// ErrNotAllowedByRuleset Dialer返回该错误时回复 connection not allowed by ruleset
+	ErrNotAllowedByRuleset = errors.New("connection not allowed by ruleset")
+	ErrNetworkUnreachable  = errors.New("network unreachable")
+	ErrHostUnreachable     = errors.New("host unreachable")
+	ErrConnectionRefused   = errors.New("connection refused")
+	ErrTTLExpired          = errors.New("TTL expired")
+	ErrATYPNotSupported    = errors.New("address type not supported")
+)
+
+// replyErrors REP对应的错误,可用errors.Is与ReplyError比较
+var replyErrors = map[byte]error{
+	RepGeneralFailure:      ErrGeneralFailure,
+	RepNotAllowedByRuleset: ErrNotAllowedByRuleset,
+	RepNetworkUnreachable:  ErrNetworkUnreachable,
+	RepHostUnreachable:     ErrHostUnreachable,
+	RepConnectionRefused:   ErrConnectionRefused,
+	RepTTLExpired:          ErrTTLExpired,
+	RepCmdNotSupported:     ErrCmdNotSupport,
+	RepATYPNotSupported:    ErrATYPNotSupported,
+}
+
+var _ net.Error = (*ReplyError)(nil)
+
+// ReplyError 代理回复的失败码
+// errors.Is可与ErrReplyFail及ErrConnectionRefused等REP对应的错误比较
+type ReplyError struct {
+	Code  byte
+	Proxy string
+}
+
+func (e *ReplyError) Error() string {
+	return fmt.Sprintf("%v: %s (REP 0x%02x)", ErrReplyFail, e.Message(), e.Code)
+}
+
+// Message REP的含义
+func (e *ReplyError) Message() string {
+	if err, ok := replyErrors[e.Code]; ok {
+		return err.Error()
+	}
+	return "unassigned"
+}
+
+func (e *ReplyError) Is(target error) bool {
+	return target == ErrReplyFail || target == replyErrors[e.Code]
+}
+
+// Timeout 实现net.Error,TTL expired时为true
+func (e *ReplyError) Timeout() bool {
+	return e.Code == RepTTLExpired
+}
+
+// Temporary 实现net.Error
+func (e *ReplyError) Temporary() bool {
+	return e.Timeout()
+}
+
+func (c *Client) replyError(rep byte) error {
+	return &ReplyError{Code: rep, Proxy: c.serverAddress}
+}
@@ -2,24 +2,59 @@ package socks5
 
 import (
 	"context"
+	"errors"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/matteo-gz/tyflo/pkg/logger"
 )
 
+// ErrServerClosed Shutdown或Close之后Serve返回该错误
+var ErrServerClosed = errors.New("socks5: server closed")
+
 type Server struct {
-	l              *net.TCPListener
 	log            logger.Logger
 	pool           *sync.Pool
 	dialer         Dialer
 	authenticators []Authenticator
+	bindTimeout    time.Duration
+	preference     []int
+	resolver       Resolver
+	hooks          hookChain
+
+	handshakeTimeout   time.Duration
+	idleTimeout        time.Duration
+	maxSessionDuration time.Duration
+
+	maxSessions int
+	maxPerIP    int
+	maxPerUser  int
+	rate        float64
+	burst       int
+
+	inShutdown atomic.Bool
+	mu         sync.Mutex
+	listeners  map[net.Listener]struct{}
+	sessions   map[*serverSession]struct{}
+	accepted   uint64
+	closed     map[CloseReason]uint64
+
+	perIP         map[string]int
+	perUser       map[string]int
+	buckets       map[string]*tokenBucket
+	bucketsPruned time.Time
+	rejected      map[RejectReason]uint64
 }
 
 const (
-	bufSize = 32 * 1024
-	alive   = 180 * time.Second
+	bufSize     = 32 * 1024
+	alive       = 180 * time.Second
+	bindTimeout = 60 * time.Second
+
+	shutdownPollMax = 500 * time.Millisecond
+	acceptDelayMax  = time.Second
 )
 
 type Option func(*Server)
@@ -42,8 +77,31 @@ func WithAuthenticator(a ...Authenticator) Option {
 	}
 }
 
+// WithBindTimeout BIND等待入站连接的超时时间
+func WithBindTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.bindTimeout = d
+	}
+}
+
+// WithMethodPreference 服务端选择认证方法的优先顺序,默认按认证器的配置顺序
+func WithMethodPreference(methods ...int) Option {
+	return func(s *Server) {
+		s.preference = methods
+	}
+}
+
+// WithResolver RESOLVE/RESOLVE_PTR使用的解析器,默认通过Dialer所在网络解析
+func WithResolver(r Resolver) Option {
+	return func(s *Server) {
+		s.resolver = r
+	}
+}
+
 func NewServer(opts ...Option) *Server {
 	s := &Server{
+		bindTimeout:      bindTimeout,
+		handshakeTimeout: handshakeTimeout,
 		pool: &sync.Pool{
 			New: func() interface{} {
 				return make([]byte, bufSize)
@@ -55,36 +113,191 @@ func NewServer(opts ...Option) *Server {
 	}
 	return s
 }
+
+// Stop 等同于Close
 func (s *Server) Stop() error {
-	return s.l.Close()
+	return s.Close()
 }
+
+// Start 监听addr并在后台Serve,ctx取消时停止接受连接并关闭所有会话
 func (s *Server) Start(ctx context.Context, addr string) (err error) {
-	a, err := net.ResolveTCPAddr(tcp, addr)
+	l, err := net.Listen(tcp, addr)
 	if err != nil {
 		return err
 	}
-	if s.l, err = net.ListenTCP(tcp, a); err != nil {
-		return err
-	}
-	go s.accept(ctx)
+	go func() {
+		if err := s.serve(ctx, l); err != nil && !errors.Is(err, ErrServerClosed) {
+			s.log.ErrorF(ctx, "serve", err)
+		}
+	}()
 	return nil
 }
 
-func (s *Server) accept(ctx context.Context) {
+// Serve 在l上接受连接直到l被关闭,Shutdown或Close之后返回ErrServerClosed
+// 其他Accept错误退避后重试
+func (s *Server) Serve(l net.Listener) error {
+	return s.serve(context.Background(), l)
+}
+
+func (s *Server) serve(ctx context.Context, l net.Listener) error {
+	if !s.trackListener(l, true) {
+		_ = l.Close()
+		return ErrServerClosed
+	}
+	defer s.trackListener(l, false)
+	stop := context.AfterFunc(ctx, func() {
+		_ = l.Close()
+	})
+	defer stop()
+	var delay time.Duration
 	for {
+		c, err := l.Accept()
+		if err != nil {
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+			if ctx.Err() != nil {
+				s.log.DebugF(ctx, "socks5 server accept leaving")
+				return ctx.Err()
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			// 其余错误(如EMFILE、ENFILE)通常是暂时的,与http.Server一样退避重试
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else {
+				delay *= 2
+			}
+			if delay > acceptDelayMax {
+				delay = acceptDelayMax
+			}
+			s.log.ErrorF(ctx, "Accept", err, delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		s.log.DebugF(ctx, "newSession")
+		sess := newSession(c, s)
+		sessCtx, cancel := context.WithCancel(ctx)
+		sess.cancel = cancel
+		if !s.trackSession(sess, true) {
+			cancel()
+			_ = c.Close()
+			continue
+		}
+		go func() {
+			defer cancel()
+			sess.handle(sessCtx)
+			s.trackSession(sess, false)
+			s.sessionClosed(sessCtx, sess)
+		}()
+	}
+}
+
+// Shutdown 停止接受连接,等待进行中的会话结束;ctx结束时强制关闭剩余会话并返回ctx的错误
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.inShutdown.Store(true)
+	err := s.closeListeners()
+	poll := time.Millisecond
+	t := time.NewTimer(poll)
+	defer t.Stop()
+	for {
+		if s.sessionCount() == 0 {
+			return err
+		}
 		select {
 		case <-ctx.Done():
-			s.log.DebugF(ctx, "socks5 server accept leaving")
-			return
-		default:
-			c, err := s.l.AcceptTCP()
-			if err != nil {
-				s.log.ErrorF(ctx, "AcceptTCP", err)
-				continue
+			s.closeSessions()
+			return ctx.Err()
+		case <-t.C:
+			if poll < shutdownPollMax {
+				poll *= 2
 			}
-			s.log.DebugF(ctx, "newSession")
-			sess := newSession(c, s.log, s.pool, s.dialer, s.authenticators)
-			go sess.handle(ctx)
+			t.Reset(poll)
 		}
 	}
 }
+
+// Close 立即关闭所有监听和会话
+func (s *Server) Close() error {
+	s.inShutdown.Store(true)
+	err := s.closeListeners()
+	s.closeSessions()
+	return err
+}
+
+func (s *Server) shuttingDown() bool {
+	return s.inShutdown.Load()
+}
+
+// trackListener 已经关闭时不再添加
+func (s *Server) trackListener(l net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !add {
+		delete(s.listeners, l)
+		return true
+	}
+	if s.shuttingDown() {
+		return false
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	s.listeners[l] = struct{}{}
+	return true
+}
+
+func (s *Server) trackSession(sess *serverSession, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !add {
+		if _, ok := s.sessions[sess]; ok {
+			delete(s.sessions, sess)
+			s.release(sess)
+		}
+		return true
+	}
+	if s.shuttingDown() {
+		return false
+	}
+	if reason := s.admit(sess); reason != "" {
+		s.reject(sess, reason)
+		return false
+	}
+	if s.sessions == nil {
+		s.sessions = make(map[*serverSession]struct{})
+	}
+	s.sessions[sess] = struct{}{}
+	s.accepted++
+	sess.id = s.accepted
+	return true
+}
+
+func (s *Server) sessionCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sessions)
+}
+
+func (s *Server) closeListeners() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var errs []error
+	for l := range s.listeners {
+		if err := l.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// closeSessions 取消会话的ctx,会话随之关闭连接
+func (s *Server) closeSessions() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sess := range s.sessions {
+		sess.closeWith(CloseReasonShutdown)
+	}
+}
@@ -0,0 +1,155 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+var (
+	ErrBindTimeout      = errors.New("bind accept timeout")
+	ErrBindPeerMismatch = errors.New("bind peer address mismatch")
+	ErrBindCtrlClosed   = errors.New("bind control connection closed")
+)
+
+// BindListener Dialer可选实现,用于BIND时在Dialer所在网络监听入站连接
+type BindListener interface {
+	Listen(ctx context.Context, addr string) (net.Listener, error)
+}
+
+func (DefaultDialer) Listen(ctx context.Context, addr string) (net.Listener, error) {
+	var lc net.ListenConfig
+	return lc.Listen(ctx, tcp, addr)
+}
+
+func (s *serverSession) bind(ctx context.Context, req *ClientRequest) error {
+	bl, ok := s.dialer.(BindListener)
+	if !ok {
+		_ = s.reply(RepCmdNotSupported, nil)
+		return ErrCmdNotSupport
+	}
+	host, _, err := net.SplitHostPort(s.c.LocalAddr().String())
+	if err != nil {
+		_ = s.reply(RepGeneralFailure, nil)
+		return err
+	}
+	l, err := bl.Listen(ctx, net.JoinHostPort(host, "0"))
+	if err != nil {
+		_ = s.reply(replyCode(err), nil)
+		return err
+	}
+	// 第一次回复:监听地址
+	if err = s.reply(RepSucceeded, l.Addr()); err != nil {
+		_ = l.Close()
+		return err
+	}
+	s.log.DebugF(ctx, "bind listen", l.Addr())
+	conn, err := s.acceptOne(ctx, l)
+	if err != nil {
+		_ = s.reply(RepGeneralFailure, nil)
+		return err
+	}
+	if err = s.checkBindPeer(ctx, req, conn.RemoteAddr()); err != nil {
+		_ = conn.Close()
+		_ = s.reply(RepNotAllowedByRuleset, nil)
+		return err
+	}
+	if conn, err = s.hooks.dialed(ctx, conn); err != nil {
+		_ = conn.Close()
+		_ = s.reply(replyCode(err), nil)
+		return err
+	}
+	// 第二次回复:入站连接的地址
+	if err = s.reply(RepSucceeded, conn.RemoteAddr()); err != nil {
+		_ = conn.Close()
+		return err
+	}
+	s.log.DebugF(ctx, "bind accepted", conn.RemoteAddr())
+	s.relay(ctx, conn, s.c)
+	return nil
+}
+
+// acceptOne 在超时内等待一个入站连接,之后关闭监听
+// 等待期间客户端关闭控制连接(或违反协议发送数据)时放弃等待
+func (s *serverSession) acceptOne(ctx context.Context, l net.Listener) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		conn, err := l.Accept()
+		ch <- result{conn, err}
+	}()
+	ctrl := make(chan error, 1)
+	go func() {
+		n, err := s.c.Read(make([]byte, 1))
+		if n > 0 || err == nil || errors.Is(err, io.EOF) {
+			err = ErrBindCtrlClosed
+		}
+		ctrl <- err
+	}()
+	t := time.NewTimer(s.bindTimeout)
+	defer t.Stop()
+	var err error
+	select {
+	case r := <-ch:
+		_ = l.Close()
+		if r.err != nil {
+			return nil, r.err
+		}
+		// 停止读控制连接,后续由relay接管
+		_ = s.c.SetReadDeadline(time.Now())
+		if err = <-ctrl; !errors.Is(err, os.ErrDeadlineExceeded) {
+			_ = r.conn.Close()
+			return nil, err
+		}
+		if err = s.c.SetReadDeadline(time.Time{}); err != nil {
+			_ = r.conn.Close()
+			return nil, err
+		}
+		return r.conn, nil
+	case err = <-ctrl:
+	case <-t.C:
+		err = ErrBindTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	_ = l.Close()
+	if r := <-ch; r.conn != nil {
+		_ = r.conn.Close()
+	}
+	return nil, err
+}
+
+// checkBindPeer 入站连接须来自请求中的DST,DST为0.0.0.0时不校验
+func (s *serverSession) checkBindPeer(ctx context.Context, req *ClientRequest, peer net.Addr) error {
+	peerHost, _, err := net.SplitHostPort(peer.String())
+	if err != nil {
+		return err
+	}
+	peerIP := net.ParseIP(peerHost)
+	var ips []net.IP
+	if req.ATYP == ATYPDomainName {
+		// 与Dialer在同一网络解析,ssh模式下解析的是远端的DNS
+		ips, err = s.resolver().LookupIP(ctx, req.host)
+		if err != nil {
+			return err
+		}
+	} else {
+		ip := net.IP(req.DSTAddr)
+		if ip.IsUnspecified() {
+			return nil
+		}
+		ips = append(ips, ip)
+	}
+	for _, ip := range ips {
+		if ip.Equal(peerIP) {
+			return nil
+		}
+	}
+	return ErrBindPeerMismatch
+}
@@ -0,0 +1,127 @@
+package socks5
+
+import (
+	"context"
+	"net"
+)
+
+// Hooks 会话各阶段的回调,字段均可为nil
+// 多组Hooks按WithHooks的顺序调用,任一回调返回错误时不再调用后面的
+type Hooks struct {
+	// OnAccept 会话开始时调用,返回错误时关闭连接
+	OnAccept func(ctx context.Context, conn net.Conn) error
+	// OnNegotiated 选定认证方法后、回复客户端前调用,返回错误时回复0xFF;SOCKS4不调用
+	OnNegotiated func(ctx context.Context, methods []byte, selected byte) error
+	// OnAuthenticated 认证通过后调用,无认证时user为空,返回错误时按认证失败处理
+	OnAuthenticated func(ctx context.Context, user string) error
+	// OnRequest 读取请求后调用,返回新的目标地址可改写请求
+	// 返回错误时拒绝请求,REP按错误映射,如ErrNotAllowedByRuleset对应0x02
+	OnRequest func(ctx context.Context, cmd byte, dst string) (string, error)
+	// OnDialed CONNECT拨号成功或BIND接受入站连接后调用,返回的连接用于中继,可以包装upstream
+	// 返回错误时关闭upstream并回复失败;包装的连接不支持CloseWrite或Unwrap() net.Conn时,一个方向结束即关闭连接
+	OnDialed func(ctx context.Context, upstream net.Conn) (net.Conn, error)
+	// OnClose 会话结束时调用
+	OnClose func(ctx context.Context, info SessionInfo, reason CloseReason)
+}
+
+// WithHooks 追加会话回调,可多次使用
+func WithHooks(h ...Hooks) Option {
+	return func(s *Server) {
+		s.hooks = append(s.hooks, h...)
+	}
+}
+
+type hookChain []Hooks
+
+func (hs hookChain) accept(ctx context.Context, conn net.Conn) error {
+	for _, h := range hs {
+		if h.OnAccept == nil {
+			continue
+		}
+		if err := h.OnAccept(ctx, conn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (hs hookChain) negotiated(ctx context.Context, methods []byte, selected byte) error {
+	for _, h := range hs {
+		if h.OnNegotiated == nil {
+			continue
+		}
+		if err := h.OnNegotiated(ctx, methods, selected); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (hs hookChain) authenticated(ctx context.Context, user string) error {
+	for _, h := range hs {
+		if h.OnAuthenticated == nil {
+			continue
+		}
+		if err := h.OnAuthenticated(ctx, user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// request 依次改写目标地址
+func (hs hookChain) request(ctx context.Context, cmd byte, dst string) (string, error) {
+	for _, h := range hs {
+		if h.OnRequest == nil {
+			continue
+		}
+		var err error
+		if dst, err = h.OnRequest(ctx, cmd, dst); err != nil {
+			return "", err
+		}
+	}
+	return dst, nil
+}
+
+// dialed 依次包装连接,出错时返回最后一个有效的连接供调用方关闭
+func (hs hookChain) dialed(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	for _, h := range hs {
+		if h.OnDialed == nil {
+			continue
+		}
+		c, err := h.OnDialed(ctx, conn)
+		if err != nil {
+			return conn, err
+		}
+		conn = c
+	}
+	return conn, nil
+}
+
+func (hs hookChain) close(ctx context.Context, info SessionInfo, reason CloseReason) {
+	for _, h := range hs {
+		if h.OnClose != nil {
+			h.OnClose(ctx, info, reason)
+		}
+	}
+}
+
+// rewrite 由OnRequest改写请求的目标地址
+func (s *serverSession) rewrite(ctx context.Context, req *ClientRequest) error {
+	if len(s.hooks) == 0 {
+		return nil
+	}
+	dst, err := s.hooks.request(ctx, req.CMD, req.GetAddress())
+	if err != nil {
+		return err
+	}
+	if dst == req.GetAddress() {
+		return nil
+	}
+	s.log.DebugF(ctx, "request rewritten", req.GetAddress(), dst)
+	if err = req.SetCmd(req.CMD, dst); err != nil {
+		return err
+	}
+	s.setAddress(req.GetAddress())
+	return nil
+}
@@ -0,0 +1,163 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+const rateBucketIdle = time.Minute
+
+// RejectReason 超过限制被拒绝的原因
+type RejectReason string
+
+const (
+	RejectMaxSessions RejectReason = "max sessions"
+	RejectMaxPerIP    RejectReason = "max sessions per ip"
+	RejectMaxPerUser  RejectReason = "max sessions per user"
+	RejectRateLimit   RejectReason = "rate limit"
+)
+
+// CloseReasonRejected 认证后超过每用户会话数或被OnRequest拒绝,回复失败后关闭
+const CloseReasonRejected CloseReason = "rejected"
+
+// WithMaxSessions 同时存在的会话总数上限,超过时直接关闭新连接,为0时不限制
+func WithMaxSessions(n int) Option {
+	return func(s *Server) {
+		s.maxSessions = n
+	}
+}
+
+// WithMaxSessionsPerIP 每个客户端IP同时存在的会话数上限,为0时不限制
+func WithMaxSessionsPerIP(n int) Option {
+	return func(s *Server) {
+		s.maxPerIP = n
+	}
+}
+
+// WithMaxSessionsPerUser 每个认证用户同时存在的会话数上限,为0时不限制
+// 用户在认证后才能确定,超过时读取请求后回复REP 0x02(SOCKS4为0x5B)
+func WithMaxSessionsPerUser(n int) Option {
+	return func(s *Server) {
+		s.maxPerUser = n
+	}
+}
+
+// WithRateLimitPerIP 每个客户端IP每秒新建连接数上限,允许burst个突发,rate为0时不限制
+func WithRateLimitPerIP(rate float64, burst int) Option {
+	if burst < 1 {
+		burst = 1
+	}
+	return func(s *Server) {
+		s.rate = rate
+		s.burst = burst
+	}
+}
+
+// tokenBucket 每个IP的新建连接令牌桶
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// admit 在s.mu下检查会话总数、每IP会话数和每IP速率,通过时登记IP
+func (s *Server) admit(sess *serverSession) RejectReason {
+	ip := sess.clientIP()
+	if s.rate > 0 && !s.allowRate(ip) {
+		return RejectRateLimit
+	}
+	if s.maxSessions > 0 && len(s.sessions) >= s.maxSessions {
+		return RejectMaxSessions
+	}
+	if s.maxPerIP > 0 && s.perIP[ip] >= s.maxPerIP {
+		return RejectMaxPerIP
+	}
+	if s.perIP == nil {
+		s.perIP = make(map[string]int)
+	}
+	s.perIP[ip]++
+	return ""
+}
+
+// allowRate 在s.mu下消耗ip的一个令牌
+func (s *Server) allowRate(ip string) bool {
+	now := time.Now()
+	if s.buckets == nil {
+		s.buckets = make(map[string]*tokenBucket)
+	}
+	if now.Sub(s.bucketsPruned) > rateBucketIdle {
+		// 长时间没有新连接的桶已经回满,可以删除
+		for k, b := range s.buckets {
+			if now.Sub(b.last) > rateBucketIdle {
+				delete(s.buckets, k)
+			}
+		}
+		s.bucketsPruned = now
+	}
+	b, ok := s.buckets[ip]
+	if !ok {
+		b = &tokenBucket{tokens: float64(s.burst), last: now}
+		s.buckets[ip] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * s.rate
+	if max := float64(s.burst); b.tokens > max {
+		b.tokens = max
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// admitUser 认证后检查每用户会话数,通过时登记用户
+func (s *Server) admitUser(sess *serverSession) bool {
+	user := sess.info().User
+	if s.maxPerUser <= 0 || user == "" {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.perUser[user] >= s.maxPerUser {
+		s.reject(sess, RejectMaxPerUser)
+		return false
+	}
+	if s.perUser == nil {
+		s.perUser = make(map[string]int)
+	}
+	s.perUser[user]++
+	sess.countedUser = user
+	return true
+}
+
+// release 在s.mu下撤销admit和admitUser的登记
+func (s *Server) release(sess *serverSession) {
+	ip := sess.clientIP()
+	if s.perIP[ip]--; s.perIP[ip] <= 0 {
+		delete(s.perIP, ip)
+	}
+	if user := sess.countedUser; user != "" {
+		if s.perUser[user]--; s.perUser[user] <= 0 {
+			delete(s.perUser, user)
+		}
+	}
+}
+
+// reject 在s.mu下计数并记录
+func (s *Server) reject(sess *serverSession, reason RejectReason) {
+	if s.rejected == nil {
+		s.rejected = make(map[RejectReason]uint64)
+	}
+	s.rejected[reason]++
+	s.log.DebugF(context.Background(), "session rejected", sess.c.RemoteAddr(), reason)
+}
+
+func (s *serverSession) clientIP() string {
+	addr := s.c.RemoteAddr().String()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
@@ -0,0 +1,205 @@
+package socks5
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+// CloseReasonKicked 通过Session.Close或CloseSessions主动关闭时可使用的原因
+const CloseReasonKicked CloseReason = "kicked"
+
+// SessionState 会话所处的阶段
+type SessionState string
+
+const (
+	// StateHandshake 协商及读取请求
+	StateHandshake SessionState = "handshake"
+	// StateAuth 认证子协商
+	StateAuth SessionState = "auth"
+	// StateRelaying 请求已成功,正在中继数据
+	StateRelaying SessionState = "relaying"
+)
+
+// SessionInfo 会话的快照
+type SessionInfo struct {
+	ID          uint64
+	ClientAddr  net.Addr
+	User        string
+	Destination string
+	Start       time.Time
+	// BytesIn 客户端发往目标的字节数,BytesOut 目标发往客户端的字节数,只统计TCP中继,最多延迟1s
+	BytesIn  uint64
+	BytesOut uint64
+	State    SessionState
+}
+
+// Session 已登记会话的句柄,会话结束后调用Close返回ErrSessionNotFound
+type Session struct {
+	srv  *Server
+	sess *serverSession
+}
+
+// Info 返回会话的当前快照
+func (h *Session) Info() SessionInfo {
+	return h.sess.info()
+}
+
+// Close 以reason关闭会话,reason会被记录和计数
+func (h *Session) Close(reason CloseReason) error {
+	if h == nil || !h.srv.registered(h.sess) {
+		return ErrSessionNotFound
+	}
+	h.sess.closeWith(reason)
+	return nil
+}
+
+// Sessions 返回所有存活会话的快照,按ID排序
+func (s *Server) Sessions() []SessionInfo {
+	s.mu.Lock()
+	infos := make([]SessionInfo, 0, len(s.sessions))
+	for sess := range s.sessions {
+		infos = append(infos, sess.info())
+	}
+	s.mu.Unlock()
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+	return infos
+}
+
+// Session 按ID查找存活的会话,不存在时返回nil
+func (s *Server) Session(id uint64) *Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sess := range s.sessions {
+		if sess.id == id {
+			return &Session{srv: s, sess: sess}
+		}
+	}
+	return nil
+}
+
+// CloseSessions 关闭filter返回true的会话,返回关闭的数量
+func (s *Server) CloseSessions(filter func(SessionInfo) bool, reason CloseReason) int {
+	s.mu.Lock()
+	sessions := make([]*serverSession, 0, len(s.sessions))
+	for sess := range s.sessions {
+		sessions = append(sessions, sess)
+	}
+	s.mu.Unlock()
+	// filter在锁外调用,可以在其中访问Server
+	n := 0
+	for _, sess := range sessions {
+		if filter(sess.info()) {
+			sess.closeWith(reason)
+			n++
+		}
+	}
+	return n
+}
+
+func (s *Server) registered(sess *serverSession) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.sessions[sess]
+	return ok
+}
+
+func (s *serverSession) info() SessionInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return SessionInfo{
+		ID:          s.id,
+		ClientAddr:  s.c.RemoteAddr(),
+		User:        s.user,
+		Destination: s.address,
+		Start:       s.start,
+		BytesIn:     s.bytesIn.Load(),
+		BytesOut:    s.bytesOut.Load(),
+		State:       s.state,
+	}
+}
+
+func (s *serverSession) setState(state SessionState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = state
+}
+
+func (s *serverSession) setUser(user string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.user = user
+}
+
+func (s *serverSession) setAddress(address string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.address = address
+}
+
+const (
+	meterChunk    = 32 * 1024
+	meterInterval = time.Second
+)
+
+// meteredWriter 统计写入的字节数,并在有数据时重置空闲计时
+type meteredWriter struct {
+	w     io.Writer
+	n     *atomic.Uint64
+	touch func()
+}
+
+func (m meteredWriter) Write(p []byte) (int, error) {
+	if m.touch != nil {
+		m.touch()
+	}
+	n, err := m.w.Write(p)
+	m.n.Add(uint64(n))
+	return n, err
+}
+
+// ReadFrom 保留底层连接的零拷贝路径(如TCP间的splice)
+// splice按块进行,每块结束后计数并重置空闲计时;读超时使数据量不足一块时也能及时结束
+func (m meteredWriter) ReadFrom(r io.Reader) (n int64, err error) {
+	rf, ok := m.w.(io.ReaderFrom)
+	if !ok {
+		// 隐藏ReadFrom,避免io.Copy再次调用自身
+		return io.Copy(struct{ io.Writer }{m}, r)
+	}
+	dl, _ := r.(interface{ SetReadDeadline(time.Time) error })
+	if dl != nil {
+		defer func() {
+			_ = dl.SetReadDeadline(time.Time{})
+		}()
+	}
+	for {
+		if dl != nil {
+			_ = dl.SetReadDeadline(time.Now().Add(meterInterval))
+		}
+		lr := &io.LimitedReader{R: r, N: meterChunk}
+		k, err := rf.ReadFrom(lr)
+		if k > 0 {
+			n += k
+			m.n.Add(uint64(k))
+			if m.touch != nil {
+				m.touch()
+			}
+		}
+		switch {
+		case dl != nil && errors.Is(err, os.ErrDeadlineExceeded):
+		case err != nil:
+			return n, err
+		case lr.N > 0:
+			// 不足一块且没有超时,读到了EOF
+			return n, nil
+		}
+	}
+}
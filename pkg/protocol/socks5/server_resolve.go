@@ -0,0 +1,100 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"strings"
+)
+
+// Resolver RESOLVE/RESOLVE_PTR扩展命令使用的解析器
+type Resolver interface {
+	LookupIP(ctx context.Context, host string) ([]net.IP, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+func (DefaultDialer) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	return net.DefaultResolver.LookupIP(ctx, "ip", host)
+}
+
+func (DefaultDialer) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return net.DefaultResolver.LookupAddr(ctx, addr)
+}
+
+// dialerResolver 通过Dialer连接DNS服务器,使解析发生在Dialer所在网络(如ssh隧道远端)
+type dialerResolver struct {
+	r *net.Resolver
+}
+
+func newDialerResolver(d Dialer) *dialerResolver {
+	return &dialerResolver{
+		r: &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				// 返回流式连接,解析器会使用DNS over TCP
+				return d.DialContext(ctx, address)
+			},
+		},
+	}
+}
+
+func (d *dialerResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	return d.r.LookupIP(ctx, "ip", host)
+}
+
+func (d *dialerResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return d.r.LookupAddr(ctx, addr)
+}
+
+func (s *serverSession) resolver() Resolver {
+	if s.res != nil {
+		return s.res
+	}
+	if r, ok := s.dialer.(Resolver); ok {
+		return r
+	}
+	return newDialerResolver(s.dialer)
+}
+
+// resolve 处理RESOLVE,回复解析出的地址,完成后关闭连接
+func (s *serverSession) resolve(ctx context.Context, req *ClientRequest) error {
+	if req.ATYP != ATYPDomainName {
+		// 已经是IP,原样返回
+		return s.reply(RepSucceeded, &net.TCPAddr{IP: net.IP(req.DSTAddr)})
+	}
+	ips, err := s.resolver().LookupIP(ctx, req.host)
+	if err != nil {
+		_ = s.reply(replyCode(err), nil)
+		return err
+	}
+	if len(ips) == 0 {
+		_ = s.reply(RepHostUnreachable, nil)
+		return &net.DNSError{Err: "no such host", Name: req.host, IsNotFound: true}
+	}
+	s.log.DebugF(ctx, "resolve", req.host, ips)
+	return s.reply(RepSucceeded, &net.TCPAddr{IP: ips[0]})
+}
+
+// resolvePTR 处理RESOLVE_PTR,回复域名,完成后关闭连接
+func (s *serverSession) resolvePTR(ctx context.Context, req *ClientRequest) error {
+	if req.ATYP == ATYPDomainName {
+		_ = s.reply(RepATYPNotSupported, nil)
+		return ErrATYPInvalid
+	}
+	names, err := s.resolver().LookupAddr(ctx, req.host)
+	if err != nil {
+		_ = s.reply(replyCode(err), nil)
+		return err
+	}
+	if len(names) == 0 {
+		_ = s.reply(RepHostUnreachable, nil)
+		return &net.DNSError{Err: "no such host", Name: req.host, IsNotFound: true}
+	}
+	s.log.DebugF(ctx, "resolve ptr", req.host, names)
+	r := NewServerReply()
+	if err = r.SetReplyAddress(RepSucceeded, net.JoinHostPort(strings.TrimSuffix(names[0], "."), "0")); err != nil {
+		_ = s.reply(RepGeneralFailure, nil)
+		return err
+	}
+	_, err = s.c.Write(r.Bytes())
+	return err
+}
@@ -1,11 +1,15 @@
 package socks5
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/matteo-gz/tyflo/pkg/logger"
@@ -22,12 +26,34 @@ const (
 )
 
 type serverSession struct {
-	c              *net.TCPConn
+	c              net.Conn
+	cancel         context.CancelFunc
 	log            logger.Logger
 	address        string
 	buf            bufCache
 	dialer         Dialer
 	authenticators []Authenticator
+	bindTimeout    time.Duration
+	preference     []int
+	res            Resolver
+	hooks          hookChain
+	version        byte
+	user           string
+
+	handshakeTimeout time.Duration
+	idleTimeout      time.Duration
+	maxDuration      time.Duration
+	mu               sync.Mutex
+	reason           CloseReason
+
+	id       uint64
+	start    time.Time
+	state    SessionState
+	bytesIn  atomic.Uint64
+	bytesOut atomic.Uint64
+
+	admitUser   func(*serverSession) bool
+	countedUser string
 }
 
 type bufCache interface {
@@ -44,130 +70,265 @@ func (DefaultDialer) DialContext(context context.Context, addr string) (conn net
 	return dial(context, addr)
 }
 
-func newSession(c *net.TCPConn, l logger.Logger, b bufCache, d Dialer, a []Authenticator) *serverSession {
+func newSession(c net.Conn, srv *Server) *serverSession {
 	return &serverSession{
 		c:              c,
-		log:            l,
-		buf:            b,
-		dialer:         d,
-		authenticators: a,
+		log:            srv.log,
+		buf:            srv.pool,
+		dialer:         srv.dialer,
+		authenticators: srv.authenticators,
+		bindTimeout:    srv.bindTimeout,
+		preference:     srv.preference,
+		res:            srv.resolver,
+		hooks:          srv.hooks,
+
+		handshakeTimeout: srv.handshakeTimeout,
+		idleTimeout:      srv.idleTimeout,
+		maxDuration:      srv.maxSessionDuration,
+
+		start:     time.Now(),
+		state:     StateHandshake,
+		admitUser: srv.admitUser,
 	}
 }
 func (s *serverSession) config() {
-	if err := s.c.SetKeepAlive(true); err != nil {
+	tc, ok := s.c.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if err := tc.SetKeepAlive(true); err != nil {
 		_ = s.c.Close()
 		return
 	}
-	if err := s.c.SetKeepAlivePeriod(alive); err != nil {
+	if err := tc.SetKeepAlivePeriod(alive); err != nil {
 		_ = s.c.Close()
 		return
 	}
 }
-func (s *serverSession) handle(ctxP context.Context) {
+
+// handle 处理会话直到结束,ctx取消时关闭连接
+func (s *serverSession) handle(ctx context.Context) {
 	s.config()
-	select {
-	case <-ctxP.Done():
+	stop := context.AfterFunc(ctx, func() {
+		_ = s.c.Close()
+	})
+	defer stop()
+	if s.maxDuration > 0 {
+		t := time.AfterFunc(s.maxDuration, func() {
+			s.closeWith(CloseReasonMaxDuration)
+		})
+		defer t.Stop()
+	}
+	if err := s.hooks.accept(ctx, s.c); err != nil {
+		s.setReason(CloseReasonError)
+		s.log.ErrorF(ctx, "accept", err)
+		_ = s.c.Close()
 		return
-	default:
-		ctx := context.Background()
-		//s.c.SetReadDeadline(time.Now()) todo set timeout
-		clientVerReq, err := s.negotiate(ctx)
+	}
+	if s.handshakeTimeout > 0 {
+		_ = s.c.SetDeadline(time.Now().Add(s.handshakeTimeout))
+	}
+	clientRequest, err := s.handshake(ctx)
+	if err != nil {
+		s.failWith(err, true)
+		s.log.ErrorF(ctx, "handshake", err)
+		_ = s.c.Close()
+		return
+	}
+	if err = s.c.SetDeadline(time.Time{}); err != nil {
+		s.failWith(err, false)
+		_ = s.c.Close()
+		return
+	}
+	s.log.DebugF(ctx, "clientRequest", clientRequest)
+	s.setAddress(clientRequest.GetAddress())
+	if !s.admitUser(s) {
+		// 用户已知,按规则拒绝
+		s.setReason(CloseReasonRejected)
+		_ = s.reply(RepNotAllowedByRuleset, nil)
+		_ = s.c.Close()
+		return
+	}
+	if err = s.rewrite(ctx, clientRequest); err != nil {
+		s.setReason(CloseReasonRejected)
+		s.log.ErrorF(ctx, "request", err)
+		_ = s.reply(replyCode(err), nil)
+		_ = s.c.Close()
+		return
+	}
+	switch clientRequest.CMD {
+	case CmdCONNECT:
+		err = s.connect(ctx)
 		if err != nil {
-			s.log.ErrorF(ctx, "negotiate", clientVerReq, err)
 			_ = s.c.Close()
+			s.failWith(err, false)
+			s.log.ErrorF(ctx, "connect", err)
 			return
 		}
-		s.log.DebugF(ctx, fmt.Sprintf("clientVerReq:%#v", clientVerReq))
-		if err = s.authenticate(ctx); err != nil {
-			s.log.ErrorF(ctx, "authenticate", err)
+	case CmdBIND:
+		err = s.bind(ctx, clientRequest)
+		if err != nil {
 			_ = s.c.Close()
+			s.failWith(err, false)
+			s.log.ErrorF(ctx, "bind", err)
 			return
 		}
-		s.log.DebugF(ctx, "authenticate-done")
-		clientRequest, err := s.handleRequest(ctx)
+	case CmdUDPAssociate:
+		err = s.udpAssociate(ctx, clientRequest)
 		if err != nil {
-			s.log.ErrorF(ctx, "handleRequest", err)
 			_ = s.c.Close()
+			s.failWith(err, false)
+			s.log.ErrorF(ctx, "udpAssociate", err)
 			return
 		}
-		s.log.DebugF(ctx, "clientRequest", clientRequest)
-		s.address = clientRequest.GetAddress()
-		switch clientRequest.CMD {
-		case CmdCONNECT:
-			err = s.connect(ctx)
-			if err != nil {
-				_ = s.c.Close()
-				s.log.ErrorF(ctx, "connect", err)
-				return
-			}
+	case CmdResolve:
+		err = s.resolve(ctx, clientRequest)
+		_ = s.c.Close()
+		if err != nil {
+			s.failWith(err, false)
+			s.log.ErrorF(ctx, "resolve", err)
+			return
 		}
+	case CmdResolvePTR:
+		err = s.resolvePTR(ctx, clientRequest)
+		_ = s.c.Close()
+		if err != nil {
+			s.failWith(err, false)
+			s.log.ErrorF(ctx, "resolvePTR", err)
+			return
+		}
+	default:
+		_ = s.reply(RepCmdNotSupported, nil)
+		_ = s.c.Close()
+		s.setReason(CloseReasonError)
+		s.log.ErrorF(ctx, "cmd", clientRequest.CMD, ErrCmdNotSupport)
+	}
+}
 
+// handshake 按首字节区分SOCKS4/SOCKS5,完成认证并读取请求
+func (s *serverSession) handshake(ctx context.Context) (req *ClientRequest, err error) {
+	ver := make([]byte, 1)
+	if _, err = io.ReadFull(s.c, ver); err != nil {
+		return
 	}
+	s.version = ver[0]
+	r := io.MultiReader(bytes.NewReader(ver), s.c)
+	if s.version == Version4 {
+		return s.handshake4(ctx, r)
+	}
+	clientVerReq, err := s.negotiate(ctx, r)
+	if err != nil {
+		s.log.ErrorF(ctx, "negotiate", clientVerReq, err)
+		return
+	}
+	s.log.DebugF(ctx, fmt.Sprintf("clientVerReq:%#v", clientVerReq))
+	if err = s.authenticate(ctx, clientVerReq); err != nil {
+		s.log.ErrorF(ctx, "authenticate", err)
+		return
+	}
+	s.log.DebugF(ctx, "authenticate-done")
+	req, err = s.handleRequest(ctx)
+	if err != nil {
+		s.log.ErrorF(ctx, "handleRequest", err)
+		return
+	}
+	return
 }
 
-func (s *serverSession) negotiate(ctx context.Context) (req *ClientNegotiateReq, err error) {
+func (s *serverSession) negotiate(ctx context.Context, r io.Reader) (req *ClientNegotiateReq, err error) {
 	req = NewClientNegotiateReq()
-	err = req.Decode(s.c)
+	err = req.Decode(r)
 	return
 }
 
-func (s *serverSession) authenticate(ctx context.Context) error {
-	if s.authenticators == nil {
-		s.log.DebugF(ctx, "no authenticator exist")
-		// 没有认证器，返回无认证协商
-		reply := NewServerNegotiateReply()
-		reply.SetNotPassword()
-		_, err := s.c.Write(reply.Bytes())
-		return err
-	}
-	isSupported := false
-	var authenticator Authenticator
-	for _, a := range s.authenticators {
-		if a.Method() == MethodNoAuthenticationRequired {
-			// first supported
-			reply := NewServerNegotiateReply()
-			reply.SetNotPassword()
-			_, err := s.c.Write(reply.Bytes())
-			return err
-		}
-		if a.Method() == MethodUsernamePassword {
-			// second supported
-			isSupported = true
-			authenticator = a
-		}
+func (s *serverSession) authenticate(ctx context.Context, req *ClientNegotiateReq) error {
+	authenticator := s.selectMethod(req.Methods)
+	reply := NewServerNegotiateReply()
+	if authenticator == nil {
+		// 没有双方都支持的方法,回复0xFF后由调用方关闭连接
+		reply.SetNoAcceptable()
+		_, _ = s.c.Write(reply.Bytes())
+		return fmt.Errorf("methods%v %w", req.Methods, ErrNoAcceptableMethods)
 	}
-	if !isSupported {
-		return ErrMethodNotSupport
+	if err := s.hooks.negotiated(ctx, req.Methods, byte(authenticator.Method())); err != nil {
+		reply.SetNoAcceptable()
+		_, _ = s.c.Write(reply.Bytes())
+		return err
 	}
-
-	// 协商成功，返回用户名密码认证
-	reply := NewServerNegotiateReply()
-	reply.SetUsernamePassword()
+	reply.Version = Version5
+	reply.Method = byte(authenticator.Method())
 	_, err := s.c.Write(reply.Bytes())
 	if err != nil {
 		return err
 	}
-	s.log.DebugF(ctx, "negotiate-success")
+	s.log.DebugF(ctx, "negotiate-success", reply.Method)
+	if reply.Method == MethodNoAuthenticationRequired {
+		return s.hooks.authenticated(ctx, "")
+	}
 	// 等待用户名密码认证
+	s.setState(StateAuth)
 	clientRequest := NewUsernamePasswordReq()
 	err = clientRequest.Decode(s.c)
 	if err != nil {
 		return err
 	}
-	s.log.DebugF(ctx, "clientRequest", clientRequest)
+	s.log.DebugF(ctx, "clientRequest", clientRequest.UNAME)
 	// 认证
-	err = authenticator.Authenticate(ctx, clientRequest.UNAME, clientRequest.PASSWD)
+	authErr := authenticator.Authenticate(ctx, clientRequest.UNAME, clientRequest.PASSWD)
+	if authErr == nil {
+		authErr = s.hooks.authenticated(ctx, clientRequest.UNAME)
+	}
 	reply2 := NewUsernamePasswordReply()
-	if err != nil {
-		s.log.ErrorF(ctx, "authenticate-failure", err)
+	if authErr != nil {
+		s.log.ErrorF(ctx, "authenticate-failure", authErr)
 		reply2.SetFailure()
 	} else {
 		s.log.DebugF(ctx, "authenticate-success")
 		reply2.SetSuccess()
+		s.setUser(clientRequest.UNAME)
 	}
-	// 返回认证结果
-	_, err = s.c.Write(reply2.Bytes())
-	return err
+	// 返回认证结果,失败时须关闭连接
+	if _, err = s.c.Write(reply2.Bytes()); err != nil {
+		return err
+	}
+	return authErr
+}
+
+// selectMethod 按服务端优先顺序选出客户端提供且有认证器的方法
+func (s *serverSession) selectMethod(offered []byte) Authenticator {
+	authenticators := s.authenticators
+	if authenticators == nil {
+		// 没有认证器,只支持无认证
+		authenticators = []Authenticator{NoAuthenticator{}}
+	}
+	supported := make(map[int]Authenticator)
+	var order []int
+	for _, a := range authenticators {
+		m := a.Method()
+		if m != MethodNoAuthenticationRequired && m != MethodUsernamePassword {
+			continue
+		}
+		if _, ok := supported[m]; ok {
+			continue
+		}
+		supported[m] = a
+		order = append(order, m)
+	}
+	if s.preference != nil {
+		order = s.preference
+	}
+	for _, m := range order {
+		a, ok := supported[m]
+		if !ok {
+			continue
+		}
+		for _, o := range offered {
+			if int(o) == m {
+				return a
+			}
+		}
+	}
+	return nil
 }
 func (s *serverSession) handleRequest(ctx context.Context) (req *ClientRequest, err error) {
 	req = NewClientRequest()
@@ -175,17 +336,43 @@ func (s *serverSession) handleRequest(ctx context.Context) (req *ClientRequest,
 	return
 }
 
+// reply 发送请求的回复,addr为绑定地址,SOCKS4会话转为对应的CD
+func (s *serverSession) reply(rep byte, addr net.Addr) error {
+	if s.version == Version4 {
+		cd := byte(Socks4Rejected)
+		if rep == RepSucceeded {
+			cd = Socks4Granted
+		}
+		return s.reply4(cd, addr)
+	}
+	r := NewServerReply()
+	r.SetReply(rep, addr)
+	_, err := s.c.Write(r.Bytes())
+	return err
+}
+
 func (s *serverSession) relay(ctx context.Context, dst, src io.ReadWriteCloser) {
 	s.log.DebugF(ctx, "relay")
+	// 会话被取消时关闭两端,结束阻塞的读
+	stop := context.AfterFunc(ctx, func() {
+		_ = dst.Close()
+		_ = src.Close()
+	})
+	defer stop()
+	s.setState(StateRelaying)
+	touch, stopIdle := s.watchIdle()
+	defer stopIdle()
 	eg, ctx := errgroup.WithContext(ctx)
 	eg.Go(func() error {
-		err := s.copy(ctx, dst, src)
+		err := s.copy(ctx, meteredWriter{w: dst, n: &s.bytesIn, touch: touch}, src)
 		s.log.DebugF(ctx, "copy-done,src->dst", err)
+		closeWrite(dst)
 		return err
 	})
 	eg.Go(func() error {
-		err := s.copy(ctx, src, dst)
+		err := s.copy(ctx, meteredWriter{w: src, n: &s.bytesOut, touch: touch}, dst)
 		s.log.DebugF(ctx, "copy-done,dst->src", err)
+		closeWrite(src)
 		return err
 	})
 	s.log.DebugF(ctx, "io wait")
@@ -203,6 +390,24 @@ func (s *serverSession) relay(ctx context.Context, dst, src io.ReadWriteCloser)
 	}
 }
 
+// closeWrite 一个方向结束后半关闭另一端,对端读到EOF后会话才能结束
+// 包装后的连接(如OnDialed返回的)通过Unwrap找到底层连接,都不支持半关闭时直接关闭,避免会话无法结束
+func closeWrite(c io.Closer) {
+	for cur := c; ; {
+		switch v := cur.(type) {
+		case interface{ CloseWrite() error }:
+			_ = v.CloseWrite()
+			return
+		case interface{ Unwrap() net.Conn }:
+			if cur = v.Unwrap(); cur != nil {
+				continue
+			}
+		}
+		_ = c.Close()
+		return
+	}
+}
+
 func (s *serverSession) copy(ctx context.Context, dst io.Writer, src io.Reader) error {
 	x := s.buf.Get()
 	defer s.buf.Put(x)
@@ -214,28 +419,62 @@ func (s *serverSession) copy(ctx context.Context, dst io.Writer, src io.Reader)
 	return err
 }
 func (s *serverSession) connect(ctx context.Context) error {
-	reply := NewServerReply()
-	reply.SetConnectDirectReply()
-	n, err := s.c.Write(reply.Bytes())
-	if err != nil {
-		return err
-	}
-	s.log.DebugF(ctx, "NewServerReply", n)
+	// 先拨号,按拨号结果回复,失败时客户端可以拿到具体原因
 	s.log.DebugF(ctx, "dial", s.address)
-	//conn, err := dial(ctx, s.address)
 	conn, err := s.dialer.DialContext(ctx, s.address)
 	if err != nil {
 		s.log.DebugF(ctx, "dial err", s.address, err)
+		_ = s.reply(replyCode(err), nil)
+		return err
+	}
+	if conn, err = s.hooks.dialed(ctx, conn); err != nil {
+		_ = conn.Close()
+		_ = s.reply(replyCode(err), nil)
+		return err
+	}
+	if err = s.reply(RepSucceeded, conn.LocalAddr()); err != nil {
+		_ = conn.Close()
 		return err
 	}
 	s.log.DebugF(ctx, "conn", conn.LocalAddr(), "\t", conn.RemoteAddr())
 	s.log.DebugF(ctx, "source", s.c.LocalAddr(), "\t", s.c.RemoteAddr())
 
-	go s.relay(ctx, conn, s.c)
-
+	s.relay(ctx, conn, s.c)
 	return nil
 
 }
+
+// replyCode 把拨号错误映射为REP,上游代理的ReplyError原样转发
+func replyCode(err error) byte {
+	var re *ReplyError
+	if errors.As(err, &re) {
+		return re.Code
+	}
+	switch {
+	case errors.Is(err, ErrNotAllowedByRuleset):
+		return RepNotAllowedByRuleset
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return RepConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return RepNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return RepHostUnreachable
+	case errors.Is(err, context.DeadlineExceeded):
+		return RepTTLExpired
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		if dnsErr.IsTimeout {
+			return RepTTLExpired
+		}
+		return RepHostUnreachable
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return RepTTLExpired
+	}
+	return RepGeneralFailure
+}
 func dial(ctx context.Context, address string) (net.Conn, error) {
 	d := &net.Dialer{
 		Timeout:   dialTimeout,
@@ -0,0 +1,67 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+)
+
+// UserIDAuthenticator 认证器可选实现,用于SOCKS4按USERID识别用户
+type UserIDAuthenticator interface {
+	AuthenticateUserID(ctx context.Context, userID string) error
+}
+
+func (NoAuthenticator) AuthenticateUserID(ctx context.Context, userID string) error {
+	return nil
+}
+
+func (s *serverSession) handshake4(ctx context.Context, r io.Reader) (*ClientRequest, error) {
+	req := NewSocks4Request()
+	if err := req.Decode(r); err != nil {
+		_ = s.reply4(Socks4Rejected, nil)
+		return nil, err
+	}
+	s.log.DebugF(ctx, "socks4 request", req.CD, req.GetAddress())
+	if err := s.identify(ctx, req.UserID); err != nil {
+		cd := byte(Socks4UserIDMismatch)
+		if errors.Is(err, ErrMethodNotSupport) {
+			// 没有认证器支持SOCKS4
+			cd = Socks4Rejected
+		}
+		_ = s.reply4(cd, nil)
+		return nil, err
+	}
+	if err := s.hooks.authenticated(ctx, req.UserID); err != nil {
+		_ = s.reply4(Socks4Rejected, nil)
+		return nil, err
+	}
+	return req.ToClientRequest(), nil
+}
+
+// identify 由支持USERID的认证器识别用户,没有认证器时不校验
+func (s *serverSession) identify(ctx context.Context, userID string) error {
+	if s.authenticators == nil {
+		s.setUser(userID)
+		return nil
+	}
+	err := ErrMethodNotSupport
+	for _, a := range s.authenticators {
+		ua, ok := a.(UserIDAuthenticator)
+		if !ok {
+			continue
+		}
+		if err = ua.AuthenticateUserID(ctx, userID); err == nil {
+			s.setUser(userID)
+			return nil
+		}
+	}
+	return err
+}
+
+func (s *serverSession) reply4(cd byte, addr net.Addr) error {
+	r := NewSocks4Reply()
+	r.SetReply(cd, addr)
+	_, err := s.c.Write(r.Bytes())
+	return err
+}
@@ -0,0 +1,70 @@
+package socks5
+
+import "context"
+
+// CloseReason 会话关闭的原因
+type CloseReason string
+
+const (
+	// CloseReasonDone 请求处理完成或一端关闭了连接
+	CloseReasonDone CloseReason = "done"
+	// CloseReasonError 握手或请求处理出错
+	CloseReasonError CloseReason = "error"
+	// CloseReasonHandshakeTimeout 超过WithHandshakeTimeout仍未完成握手
+	CloseReasonHandshakeTimeout CloseReason = "handshake timeout"
+	// CloseReasonIdleTimeout 超过WithIdleTimeout没有数据
+	CloseReasonIdleTimeout CloseReason = "idle timeout"
+	// CloseReasonMaxDuration 超过WithMaxSessionDuration
+	CloseReasonMaxDuration CloseReason = "max duration"
+	// CloseReasonShutdown 服务关闭或ctx取消
+	CloseReasonShutdown CloseReason = "shutdown"
+)
+
+// ServerStats 服务端计数
+type ServerStats struct {
+	Accepted uint64
+	Active   int
+	// Closed 按原因统计已关闭的会话
+	Closed map[CloseReason]uint64
+	// Rejected 按原因统计超过限制被拒绝的连接
+	Rejected map[RejectReason]uint64
+}
+
+// Stats 返回当前计数
+func (s *Server) Stats() ServerStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	closed := make(map[CloseReason]uint64, len(s.closed))
+	for r, n := range s.closed {
+		closed[r] = n
+	}
+	rejected := make(map[RejectReason]uint64, len(s.rejected))
+	for r, n := range s.rejected {
+		rejected[r] = n
+	}
+	return ServerStats{
+		Accepted: s.accepted,
+		Active:   len(s.sessions),
+		Closed:   closed,
+		Rejected: rejected,
+	}
+}
+
+// sessionClosed 确定会话的关闭原因,记录、计数并调用OnClose,ctx为会话的ctx
+func (s *Server) sessionClosed(ctx context.Context, sess *serverSession) {
+	reason := sess.closeReason()
+	if reason == "" {
+		reason = CloseReasonDone
+		if ctx.Err() != nil {
+			reason = CloseReasonShutdown
+		}
+	}
+	s.log.DebugF(ctx, "session closed", sess.c.RemoteAddr(), reason)
+	s.mu.Lock()
+	if s.closed == nil {
+		s.closed = make(map[CloseReason]uint64)
+	}
+	s.closed[reason]++
+	s.mu.Unlock()
+	s.hooks.close(ctx, sess.info(), reason)
+}
@@ -0,0 +1,78 @@
+package socks5
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+const (
+	handshakeTimeout = 30 * time.Second
+)
+
+// WithHandshakeTimeout 协商、认证和读取请求的总超时时间,为0时不限制,默认30s
+func WithHandshakeTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.handshakeTimeout = d
+	}
+}
+
+// WithIdleTimeout 中继的连接或UDP关联双向都没有数据超过d时关闭会话,为0时不限制
+func WithIdleTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.idleTimeout = d
+	}
+}
+
+// WithMaxSessionDuration 会话从建立起的最长存活时间,为0时不限制
+func WithMaxSessionDuration(d time.Duration) Option {
+	return func(s *Server) {
+		s.maxSessionDuration = d
+	}
+}
+
+// closeWith 记录原因并关闭会话,先记录的原因生效
+func (s *serverSession) closeWith(reason CloseReason) {
+	s.setReason(reason)
+	s.cancel()
+}
+
+func (s *serverSession) setReason(reason CloseReason) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.reason == "" {
+		s.reason = reason
+	}
+}
+
+func (s *serverSession) closeReason() CloseReason {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reason
+}
+
+// failWith 按错误记录关闭原因,握手阶段的超时记为CloseReasonHandshakeTimeout
+func (s *serverSession) failWith(err error, handshake bool) {
+	if handshake && errors.Is(err, os.ErrDeadlineExceeded) {
+		s.setReason(CloseReasonHandshakeTimeout)
+		return
+	}
+	s.setReason(CloseReasonError)
+}
+
+// watchIdle 空闲超过idleTimeout时关闭会话,返回的touch在有数据时调用
+func (s *serverSession) watchIdle() (touch func(), stop func()) {
+	if s.idleTimeout <= 0 {
+		return nil, func() {}
+	}
+	t := time.AfterFunc(s.idleTimeout, func() {
+		s.closeWith(CloseReasonIdleTimeout)
+	})
+	touch = func() {
+		t.Reset(s.idleTimeout)
+	}
+	stop = func() {
+		t.Stop()
+	}
+	return
+}
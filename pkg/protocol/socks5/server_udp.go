@@ -0,0 +1,216 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/matteo-gz/tyflo/pkg/logger"
+	"golang.org/x/sync/errgroup"
+)
+
+var (
+	ErrAssociationClosed = errors.New("udp association closed")
+)
+
+const (
+	udpBufSize = 64 * 1024
+)
+
+// PacketListener Dialer可选实现,用于UDP ASSOCIATE时在Dialer所在网络分配UDP socket
+type PacketListener interface {
+	ListenPacket(ctx context.Context) (net.PacketConn, error)
+}
+
+func (DefaultDialer) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	var lc net.ListenConfig
+	return lc.ListenPacket(ctx, udp, ":0")
+}
+
+func (s *serverSession) udpAssociate(ctx context.Context, req *ClientRequest) error {
+	pl, ok := s.dialer.(PacketListener)
+	if !ok {
+		_ = s.reply(RepCmdNotSupported, nil)
+		return ErrCmdNotSupport
+	}
+	upstream, err := pl.ListenPacket(ctx)
+	if err != nil {
+		_ = s.reply(replyCode(err), nil)
+		return err
+	}
+	// 中继socket绑定在客户端连入的地址上,保证客户端可达
+	host, _, err := net.SplitHostPort(s.c.LocalAddr().String())
+	if err != nil {
+		_ = upstream.Close()
+		_ = s.reply(RepGeneralFailure, nil)
+		return err
+	}
+	var lc net.ListenConfig
+	relay, err := lc.ListenPacket(ctx, udp, net.JoinHostPort(host, "0"))
+	if err != nil {
+		_ = upstream.Close()
+		_ = s.reply(RepGeneralFailure, nil)
+		return err
+	}
+	if err = s.reply(RepSucceeded, relay.LocalAddr()); err != nil {
+		_ = upstream.Close()
+		_ = relay.Close()
+		return err
+	}
+	s.log.DebugF(ctx, "udp associate", relay.LocalAddr(), upstream.LocalAddr())
+	a := newUDPAssociation(s.c, relay, upstream, s.log, req)
+	s.setState(StateRelaying)
+	touch, stopIdle := s.watchIdle()
+	defer stopIdle()
+	a.touch = touch
+	a.serve(ctx)
+	return nil
+}
+
+// udpAssociation 一个UDP ASSOCIATE的生命周期,随控制连接关闭而结束
+type udpAssociation struct {
+	ctrl     net.Conn
+	relay    net.PacketConn
+	upstream net.PacketConn
+	log      logger.Logger
+	// touch 两个方向有数据包时重置会话的空闲计时,为nil时不计时
+	touch func()
+
+	clientIP   net.IP
+	clientPort int
+	mu         sync.Mutex
+	client     net.Addr
+}
+
+func newUDPAssociation(ctrl net.Conn, relay, upstream net.PacketConn, l logger.Logger, req *ClientRequest) *udpAssociation {
+	a := &udpAssociation{
+		ctrl:     ctrl,
+		relay:    relay,
+		upstream: upstream,
+		log:      l,
+	}
+	if host, _, err := net.SplitHostPort(ctrl.RemoteAddr().String()); err == nil {
+		a.clientIP = net.ParseIP(host)
+	}
+	// 请求中的DST为客户端发送数据所用的地址,端口为0表示未知
+	a.clientPort = int(req.DSTPort)
+	return a
+}
+
+func (a *udpAssociation) serve(ctx context.Context) {
+	eg, ctx := errgroup.WithContext(ctx)
+	eg.Go(func() error {
+		_, err := io.Copy(io.Discard, a.ctrl)
+		a.log.DebugF(ctx, "udp ctrl closed", err)
+		return ErrAssociationClosed
+	})
+	eg.Go(func() error {
+		return a.clientToRemote(ctx)
+	})
+	eg.Go(func() error {
+		return a.remoteToClient(ctx)
+	})
+	go func() {
+		<-ctx.Done()
+		a.close()
+	}()
+	err := eg.Wait()
+	a.log.DebugF(ctx, "udp associate done", err)
+}
+
+func (a *udpAssociation) close() {
+	_ = a.ctrl.Close()
+	_ = a.relay.Close()
+	_ = a.upstream.Close()
+}
+
+// allow 只接受来自关联客户端的数据包,首个合法数据包锁定客户端地址
+func (a *udpAssociation) allow(from net.Addr) bool {
+	addr, ok := from.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	if a.clientIP != nil && !a.clientIP.Equal(addr.IP) {
+		return false
+	}
+	if a.clientPort != 0 && a.clientPort != addr.Port {
+		return false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.client == nil {
+		a.client = addr
+		return true
+	}
+	return a.client.String() == addr.String()
+}
+
+func (a *udpAssociation) clientAddr() net.Addr {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.client
+}
+
+func (a *udpAssociation) active() {
+	if a.touch != nil {
+		a.touch()
+	}
+}
+
+func (a *udpAssociation) clientToRemote(ctx context.Context) error {
+	buf := make([]byte, udpBufSize)
+	for {
+		n, from, err := a.relay.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		if !a.allow(from) {
+			a.log.DebugF(ctx, "udp drop foreign datagram", from)
+			continue
+		}
+		d := NewUDPDatagram()
+		if err = d.Decode(bytes.NewReader(buf[:n])); err != nil {
+			a.log.DebugF(ctx, "udp decode", err)
+			continue
+		}
+		if d.FRAG != 0 {
+			a.log.DebugF(ctx, "udp drop", ErrFragNotSupport)
+			continue
+		}
+		dst, err := net.ResolveUDPAddr(udp, d.GetAddress())
+		if err != nil {
+			a.log.DebugF(ctx, "udp resolve", d.GetAddress(), err)
+			continue
+		}
+		a.active()
+		if _, err = a.upstream.WriteTo(d.Data, dst); err != nil {
+			a.log.DebugF(ctx, "udp write upstream", dst, err)
+		}
+	}
+}
+
+func (a *udpAssociation) remoteToClient(ctx context.Context) error {
+	buf := make([]byte, udpBufSize)
+	for {
+		n, from, err := a.upstream.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		client := a.clientAddr()
+		if client == nil {
+			continue
+		}
+		d := NewUDPDatagram()
+		if err = d.SetData(from.String(), buf[:n]); err != nil {
+			a.log.DebugF(ctx, "udp encode", from, err)
+			continue
+		}
+		a.active()
+		if _, err = a.relay.WriteTo(d.Bytes(), client); err != nil {
+			a.log.DebugF(ctx, "udp write client", client, err)
+		}
+	}
+}
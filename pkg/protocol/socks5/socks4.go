@@ -0,0 +1,231 @@
+package socks5
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// ref doc: https://www.openssh.com/txt/socks4.protocol
+// ref doc: https://www.openssh.com/txt/socks4a.protocol
+
+const (
+	Version4             = 4
+	Socks4ReplyVersion   = 0
+	Socks4Granted        = 0x5A
+	Socks4Rejected       = 0x5B
+	Socks4NoIdentd       = 0x5C
+	Socks4UserIDMismatch = 0x5D
+	socks4FieldMaxLen    = 255
+)
+
+var (
+	ErrVersionNotV4   = errors.New("version is not 4")
+	ErrFieldTooLong   = errors.New("socks4 field over 255")
+	ErrSocks4Rejected = errors.New("socks4 request rejected")
+)
+
+// Socks4Request SOCKS4/4a请求,DSTIP为0.0.0.x时为4a,域名跟在USERID之后
+//
+//	+----+----+----+----+----+----+----+----+----+----+....+----+----+....+----+
+//	| VN | CD | DSTPORT |      DSTIP        | USERID       |NULL| HOST    |NULL|
+//	+----+----+----+----+----+----+----+----+----+----+....+----+----+....+----+
+type Socks4Request struct {
+	VN      byte
+	CD      byte
+	DSTPort uint16
+	DSTIP   net.IP
+	UserID  string
+	host    string
+}
+
+func NewSocks4Request() *Socks4Request {
+	return &Socks4Request{}
+}
+
+// Decode 变长字段逐字节读取,不会多读后续数据
+func (req *Socks4Request) Decode(r io.Reader) (err error) {
+	buf := make([]byte, 8)
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		return
+	}
+	req.VN = buf[0]
+	if req.VN != Version4 {
+		return ErrVersionNotV4
+	}
+	req.CD = buf[1]
+	switch req.CD {
+	case CmdCONNECT:
+	case CmdBIND:
+	default:
+		return ErrCmdNotSupport
+	}
+	req.DSTPort = binary.BigEndian.Uint16(buf[2:4])
+	req.DSTIP = net.IP(buf[4:8])
+	if req.UserID, err = readNulString(r); err != nil {
+		return
+	}
+	req.host = req.DSTIP.String()
+	if req.isSocks4a() {
+		if req.host, err = readNulString(r); err != nil {
+			return
+		}
+	}
+	return nil
+}
+
+// isSocks4a DSTIP为0.0.0.x(x非0)
+func (req *Socks4Request) isSocks4a() bool {
+	return req.DSTIP[0] == 0 && req.DSTIP[1] == 0 && req.DSTIP[2] == 0 && req.DSTIP[3] != 0
+}
+
+func (req *Socks4Request) GetAddress() string {
+	return net.JoinHostPort(req.host, strconv.Itoa(int(req.DSTPort)))
+}
+
+// SetCmd 域名使用4a格式
+func (req *Socks4Request) SetCmd(cmd byte, address, userID string) (err error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return
+	}
+	portNum, err := strconv.Atoi(portStr)
+	if err != nil {
+		return
+	}
+	if len(userID) > socks4FieldMaxLen || len(host) > socks4FieldMaxLen {
+		return ErrFieldTooLong
+	}
+	req.VN = Version4
+	req.CD = cmd
+	req.DSTPort = uint16(portNum)
+	req.UserID = userID
+	req.host = host
+	if ip := net.ParseIP(host).To4(); ip != nil {
+		req.DSTIP = ip
+		return nil
+	}
+	if net.ParseIP(host) != nil {
+		// SOCKS4不支持IPv6
+		return ErrHostInvalid
+	}
+	req.DSTIP = net.IPv4(0, 0, 0, 1).To4()
+	return nil
+}
+func (req *Socks4Request) Bytes() []byte {
+	d := []byte{req.VN, req.CD}
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, req.DSTPort)
+	d = append(d, b...)
+	d = append(d, req.DSTIP.To4()...)
+	d = append(d, req.UserID...)
+	d = append(d, 0)
+	if req.isSocks4a() {
+		d = append(d, req.host...)
+		d = append(d, 0)
+	}
+	return d
+}
+
+// ToClientRequest 转为SOCKS5请求,复用CONNECT/BIND的处理
+func (req *Socks4Request) ToClientRequest() *ClientRequest {
+	c := &ClientRequest{
+		VER:     Version4,
+		CMD:     req.CD,
+		RSV:     RSVDefault,
+		DSTPort: req.DSTPort,
+		host:    req.host,
+	}
+	if req.isSocks4a() {
+		c.ATYP = ATYPDomainName
+		c.DSTAddr = []byte(req.host)
+	} else {
+		c.ATYP = ATYPIPV4Address
+		c.DSTAddr = req.DSTIP.To4()
+	}
+	return c
+}
+
+type Socks4Reply struct {
+	VN      byte
+	CD      byte
+	DSTPort uint16
+	DSTIP   net.IP
+}
+
+func NewSocks4Reply() *Socks4Reply {
+	return &Socks4Reply{}
+}
+
+// SetReply addr不是IPv4时回复0.0.0.0:0
+func (s *Socks4Reply) SetReply(cd byte, addr net.Addr) {
+	s.VN = Socks4ReplyVersion
+	s.CD = cd
+	s.DSTIP = net.IPv4zero.To4()
+	s.DSTPort = 0
+	if addr == nil {
+		return
+	}
+	host, portStr, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return
+	}
+	if ip := net.ParseIP(host).To4(); ip != nil {
+		s.DSTIP = ip
+		s.DSTPort = uint16(port)
+	}
+}
+func (s *Socks4Reply) GetAddress() string {
+	return net.JoinHostPort(s.DSTIP.String(), strconv.Itoa(int(s.DSTPort)))
+}
+func (s *Socks4Reply) Bytes() []byte {
+	d := []byte{s.VN, s.CD}
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, s.DSTPort)
+	d = append(d, b...)
+	return append(d, s.DSTIP.To4()...)
+}
+func (s *Socks4Reply) Decode(r io.Reader) (err error) {
+	buf := make([]byte, 8)
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		return
+	}
+	s.VN = buf[0]
+	if s.VN != Socks4ReplyVersion {
+		return ErrBadVersion
+	}
+	s.CD = buf[1]
+	s.DSTPort = binary.BigEndian.Uint16(buf[2:4])
+	s.DSTIP = net.IP(buf[4:8])
+	if s.CD != Socks4Granted {
+		return fmt.Errorf("%w %#x", ErrSocks4Rejected, s.CD)
+	}
+	return nil
+}
+
+// readNulString 逐字节读取以0结尾的字段,避免多读后续数据
+func readNulString(r io.Reader) (string, error) {
+	var d []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		if b[0] == 0 {
+			return string(d), nil
+		}
+		if len(d) >= socks4FieldMaxLen {
+			return "", ErrFieldTooLong
+		}
+		d = append(d, b[0])
+	}
+}
@@ -17,27 +17,41 @@ const (
 	MethodNoAuthenticationRequired = 0x0
 	MethodGSSAPI                   = 0x1
 	MethodUsernamePassword         = 0x2
+	MethodNoAcceptable             = 0xFF
 	CmdCONNECT                     = 0x01
 	CmdBIND                        = 0x02
 	CmdUDPAssociate                = 0x03
+	CmdResolve                     = 0xF0 // tor扩展
+	CmdResolvePTR                  = 0xF1 // tor扩展
 	RSVDefault                     = 0x00
 	ATYPIPV4Address                = 0x01
 	ATYPDomainName                 = 0x03
 	ATYPIPV6Address                = 0x04
 	RepSucceeded                   = 0x0
+	RepGeneralFailure              = 0x01
+	RepNotAllowedByRuleset         = 0x02
+	RepNetworkUnreachable          = 0x03
+	RepHostUnreachable             = 0x04
+	RepConnectionRefused           = 0x05
+	RepTTLExpired                  = 0x06
+	RepCmdNotSupported             = 0x07
+	RepATYPNotSupported            = 0x08
 )
 
 var (
-	ErrVersionNotSupport = errors.New("version not support")
-	ErrVersionNotV5      = errors.New("version is not 5")
-	ErrBadVersion        = errors.New("bad version")
-	ErrMethodLen         = errors.New("method len is 0")
-	ErrCmdNotSupport     = errors.New("cmd not support")
-	ErrRsvInvalid        = errors.New("request rsv invalid")
-	ErrATYPInvalid       = errors.New("request ATYP invalid")
-	ErrMethodNotSupport  = errors.New("method not support")
-	ErrHostInvalid       = errors.New("host invalid")
-	ErrUserPasswordLen   = errors.New("user or password len over 255")
+	ErrVersionNotSupport   = errors.New("version not support")
+	ErrVersionNotV5        = errors.New("version is not 5")
+	ErrBadVersion          = errors.New("bad version")
+	ErrMethodLen           = errors.New("method len is 0")
+	ErrCmdNotSupport       = errors.New("cmd not support")
+	ErrRsvInvalid          = errors.New("request rsv invalid")
+	ErrATYPInvalid         = errors.New("request ATYP invalid")
+	ErrMethodNotSupport    = errors.New("method not support")
+	ErrNoAcceptableMethods = errors.New("no acceptable methods")
+	ErrHostInvalid         = errors.New("host invalid")
+	ErrUserPasswordLen     = errors.New("user or password len over 255")
+	ErrFragNotSupport      = errors.New("udp frag not support")
+	ErrAuthFailed          = errors.New("username/password authentication failed")
 )
 
 type Message interface {
@@ -87,6 +101,11 @@ func (req *ClientNegotiateReq) SetUsernamePassword() {
 	req.NMethods = byte(len(req.Methods))
 	req.Version = Version5
 }
+func (req *ClientNegotiateReq) SetMethods(methods ...byte) {
+	req.Methods = methods
+	req.NMethods = byte(len(req.Methods))
+	req.Version = Version5
+}
 func (req *ClientNegotiateReq) Bytes() []byte {
 	data := []byte{req.Version, req.NMethods}
 	data = append(data, req.Methods...)
@@ -112,6 +131,10 @@ func (s *ServerNegotiateReply) SetUsernamePassword() {
 	s.Version = Version5
 	s.Method = MethodUsernamePassword
 }
+func (s *ServerNegotiateReply) SetNoAcceptable() {
+	s.Version = Version5
+	s.Method = MethodNoAcceptable
+}
 func (s *ServerNegotiateReply) Decode(r io.Reader) error {
 	buf := make([]byte, 2)
 	_, err := io.ReadFull(r, buf)
@@ -166,6 +189,8 @@ func (c *ClientRequest) Decode(r io.Reader) (err error) {
 	case CmdCONNECT:
 	case CmdBIND:
 	case CmdUDPAssociate:
+	case CmdResolve:
+	case CmdResolvePTR:
 	default:
 		return ErrCmdNotSupport
 	}
@@ -174,33 +199,10 @@ func (c *ClientRequest) Decode(r io.Reader) (err error) {
 		return ErrRsvInvalid
 	}
 	c.ATYP = buf[3]
-	var addrLen int
-	switch c.ATYP {
-	case ATYPIPV4Address:
-		addrLen = net.IPv4len
-	case ATYPDomainName:
-		buf = make([]byte, 1)
-		_, err = io.ReadFull(r, buf)
-		if err != nil {
-			return
-		}
-		addrLen = int(buf[0])
-	case ATYPIPV6Address:
-		addrLen = net.IPv6len
-	default:
-		return ErrATYPInvalid
-	}
-	buf = make([]byte, addrLen)
-	_, err = io.ReadFull(r, buf)
+	c.DSTAddr, c.host, err = readAddr(r, c.ATYP)
 	if err != nil {
 		return
 	}
-	if c.ATYP == ATYPDomainName {
-		c.host = string(buf)
-	} else {
-		c.host = net.IP(buf).String()
-	}
-	c.DSTAddr = buf
 	buf = make([]byte, 2)
 	_, err = io.ReadFull(r, buf)
 	if err != nil {
@@ -213,8 +215,11 @@ func (c *ClientRequest) GetAddress() string {
 	return net.JoinHostPort(c.host, strconv.Itoa(int(c.DSTPort)))
 }
 func (c *ClientRequest) SetCmdConnect(address string) (err error) {
+	return c.SetCmd(CmdCONNECT, address)
+}
+func (c *ClientRequest) SetCmd(cmd byte, address string) (err error) {
 	c.VER = Version5
-	c.CMD = CmdCONNECT
+	c.CMD = cmd
 	c.RSV = RSVDefault
 	host, portStr, err := net.SplitHostPort(address)
 	if err != nil {
@@ -225,25 +230,9 @@ func (c *ClientRequest) SetCmdConnect(address string) (err error) {
 		return
 	}
 	c.DSTPort = uint16(portNum)
-	if ip := net.ParseIP(host); ip != nil {
-		if ipv4 := ip.To4(); ipv4 != nil {
-			c.ATYP = ATYPIPV4Address
-			c.DSTAddr = ipv4
-		} else {
-			c.ATYP = ATYPIPV6Address
-			c.DSTAddr = ip.To16()
-		}
-	} else {
-		c.ATYP = ATYPDomainName
-		hl := len(host)
-		if hl > math.MaxUint8 {
-			err = ErrHostInvalid
-			return
-		}
-		c.DSTAddr = append(c.DSTAddr, uint8(hl))
-		c.DSTAddr = append(c.DSTAddr, []byte(host)...)
-	}
-	return nil
+	c.ATYP, c.DSTAddr, err = encodeHost(host)
+	c.host = host
+	return
 }
 func (c *ClientRequest) Bytes() []byte {
 	d := []byte{
@@ -297,6 +286,45 @@ func (s *ServerReply) SetConnectDirectReply() {
 	}
 	s.BNDPort = 0
 }
+
+// SetReply 按rep和绑定地址设置回复,addr为nil时使用0.0.0.0:0
+func (s *ServerReply) SetReply(rep byte, addr net.Addr) {
+	if addr != nil && s.SetReplyAddress(rep, addr.String()) == nil {
+		return
+	}
+	s.VER = Version5
+	s.REP = rep
+	s.RSV = RSVDefault
+	s.ATYP = ATYPIPV4Address
+	s.BNDAddr = make([]byte, net.IPv4len)
+	s.BNDPort = 0
+}
+
+// SetReplyAddress 按rep和host:port设置回复,host可以是域名
+func (s *ServerReply) SetReplyAddress(rep byte, address string) (err error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return
+	}
+	atyp, bndAddr, err := encodeHost(host)
+	if err != nil {
+		return
+	}
+	s.VER = Version5
+	s.REP = rep
+	s.RSV = RSVDefault
+	s.ATYP = atyp
+	s.BNDAddr = bndAddr
+	s.BNDPort = uint16(port)
+	return nil
+}
+func (s *ServerReply) GetAddress() string {
+	return net.JoinHostPort(s.host, strconv.Itoa(int(s.BNDPort)))
+}
 func (s *ServerReply) Decode(r io.Reader) (err error) {
 	buf := make([]byte, 4)
 	_, err = io.ReadFull(r, buf)
@@ -313,12 +341,108 @@ func (s *ServerReply) Decode(r io.Reader) (err error) {
 		return ErrRsvInvalid
 	}
 	s.ATYP = buf[3]
+	s.BNDAddr, s.host, err = readAddr(r, s.ATYP)
+	if err != nil {
+		return
+	}
+	buf = make([]byte, 2)
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		return
+	}
+	s.BNDPort = binary.BigEndian.Uint16(buf)
+	return nil
+}
+
+// UDPDatagram UDP ASSOCIATE 中转的数据包
+//
+//	+----+------+------+----------+----------+----------+
+//	|RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
+//	+----+------+------+----------+----------+----------+
+//	| 2  |  1   |  1   | Variable |    2     | Variable |
+//	+----+------+------+----------+----------+----------+
+type UDPDatagram struct {
+	RSV     uint16
+	FRAG    byte
+	ATYP    byte
+	DSTAddr []byte
+	DSTPort uint16
+	Data    []byte
+	host    string
+}
+
+func NewUDPDatagram() *UDPDatagram {
+	return &UDPDatagram{}
+}
+
+// Decode 读取整个数据包,DST之后的内容全部作为Data
+func (d *UDPDatagram) Decode(r io.Reader) (err error) {
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		return
+	}
+	d.RSV = binary.BigEndian.Uint16(buf[:2])
+	if d.RSV != RSVDefault {
+		return ErrRsvInvalid
+	}
+	d.FRAG = buf[2]
+	d.ATYP = buf[3]
+	d.DSTAddr, d.host, err = readAddr(r, d.ATYP)
+	if err != nil {
+		return
+	}
+	buf = make([]byte, 2)
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		return
+	}
+	d.DSTPort = binary.BigEndian.Uint16(buf)
+	d.Data, err = io.ReadAll(r)
+	return
+}
+func (d *UDPDatagram) SetData(address string, data []byte) (err error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return
+	}
+	portNum, err := strconv.Atoi(portStr)
+	if err != nil {
+		return
+	}
+	d.RSV = RSVDefault
+	d.FRAG = 0
+	d.DSTPort = uint16(portNum)
+	d.ATYP, d.DSTAddr, err = encodeHost(host)
+	if err != nil {
+		return
+	}
+	d.host = host
+	d.Data = data
+	return nil
+}
+func (d *UDPDatagram) GetAddress() string {
+	return net.JoinHostPort(d.host, strconv.Itoa(int(d.DSTPort)))
+}
+func (d *UDPDatagram) Bytes() []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, d.RSV)
+	b = append(b, d.FRAG, d.ATYP)
+	b = append(b, d.DSTAddr...)
+	p := make([]byte, 2)
+	binary.BigEndian.PutUint16(p, d.DSTPort)
+	b = append(b, p...)
+	return append(b, d.Data...)
+}
+
+// readAddr 按ATYP读取地址,域名不含长度字节
+func readAddr(r io.Reader, atyp byte) (addr []byte, host string, err error) {
 	var addrLen int
-	switch s.ATYP {
+	switch atyp {
 	case ATYPIPV4Address:
 		addrLen = net.IPv4len
 	case ATYPDomainName:
-		buf = make([]byte, 1)
+		buf := make([]byte, 1)
 		_, err = io.ReadFull(r, buf)
 		if err != nil {
 			return
@@ -327,26 +451,38 @@ func (s *ServerReply) Decode(r io.Reader) (err error) {
 	case ATYPIPV6Address:
 		addrLen = net.IPv6len
 	default:
-		return ErrATYPInvalid
+		err = ErrATYPInvalid
+		return
 	}
-	buf = make([]byte, addrLen)
-	_, err = io.ReadFull(r, buf)
+	addr = make([]byte, addrLen)
+	_, err = io.ReadFull(r, addr)
 	if err != nil {
 		return
 	}
-	if s.ATYP == ATYPDomainName {
-		s.host = string(buf)
+	if atyp == ATYPDomainName {
+		host = string(addr)
 	} else {
-		s.host = net.IP(buf).String()
+		host = net.IP(addr).String()
 	}
-	s.BNDAddr = buf
-	buf = make([]byte, 2)
-	_, err = io.ReadFull(r, buf)
-	if err != nil {
+	return
+}
+
+// encodeHost 把host编码为ATYP和报文中的地址,域名带长度字节
+func encodeHost(host string) (atyp byte, addr []byte, err error) {
+	if ip := net.ParseIP(host); ip != nil {
+		if ipv4 := ip.To4(); ipv4 != nil {
+			return ATYPIPV4Address, ipv4, nil
+		}
+		return ATYPIPV6Address, ip.To16(), nil
+	}
+	hl := len(host)
+	if hl > math.MaxUint8 {
+		err = ErrHostInvalid
 		return
 	}
-	s.BNDPort = binary.BigEndian.Uint16(buf)
-	return nil
+	addr = append(addr, uint8(hl))
+	addr = append(addr, []byte(host)...)
+	return ATYPDomainName, addr, nil
 }
 
 type UsernamePasswordReq struct {
@@ -448,7 +584,7 @@ func (reply *UsernamePasswordReply) Decode(r io.Reader) (err error) {
 		return ErrBadVersion
 	}
 	if reply.STATUS != UserPasswordOk {
-		return ErrReplyFail
+		return ErrAuthFailed
 	}
 	return nil
 }
@@ -2,4 +2,5 @@ package socks5
 
 const (
 	tcp = "tcp"
+	udp = "udp"
 )
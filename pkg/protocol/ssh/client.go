@@ -117,6 +117,35 @@ func (c *Client) DialContext(ctx context.Context, addr string) (conn net.Conn, e
 	conn, err = c.c.DialContext(ctx, "tcp", addr)
 	return conn, err
 }
+
+// Listen 在ssh服务端监听,远端无法识别本地地址,只沿用端口
+// 监听在0.0.0.0上,Addr返回ssh服务端的地址,BIND的对端才能连上
+func (c *Client) Listen(ctx context.Context, addr string) (l net.Listener, err error) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+	l, err = c.c.Listen("tcp", net.JoinHostPort("0.0.0.0", port))
+	if err != nil {
+		return
+	}
+	return &remoteListener{Listener: l, host: c.c.RemoteAddr()}, nil
+}
+
+// remoteListener 把未指定的监听地址替换为ssh服务端的地址
+type remoteListener struct {
+	net.Listener
+	host net.Addr
+}
+
+func (l *remoteListener) Addr() net.Addr {
+	addr, ok := l.Listener.Addr().(*net.TCPAddr)
+	host, hok := l.host.(*net.TCPAddr)
+	if !ok || !hok || !addr.IP.IsUnspecified() {
+		return l.Listener.Addr()
+	}
+	return &net.TCPAddr{IP: host.IP, Port: addr.Port}
+}
 func (c *Client) Close() error {
 	return c.c.Close()
 }